@@ -0,0 +1,323 @@
+package netlib
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	"github.com/gzjjyz/netlib/log"
+)
+
+var (
+	ErrServerFull  = errors.New("server full")
+	ErrMaintenance = errors.New("server in maintenance")
+	ErrBanned      = errors.New("address banned")
+	ErrDenied      = errors.New("address denied")
+)
+
+const (
+	// rejectWriteTimeout bounds writing the final frame to a rejected peer.
+	rejectWriteTimeout = time.Second
+	// rejectHandshakeTimeout bounds the handshake of a rejected TCP peer
+	// which has to get a final frame.
+	rejectHandshakeTimeout = 3 * time.Second
+)
+
+// AdmitMeta describes a connection waiting for admission.
+type AdmitMeta struct {
+	// Network is the network of the server, e.g. "tcp", "unix" or "udp",
+	// and "ws" for WSServer.
+	Network string
+	// TLS is the connection state of WS connections over TLS. It is always
+	// nil for TCP connections, which are admitted right after accept,
+	// before the TLS handshake; check their certificates in the Handshake
+	// hook or NewAgent instead.
+	TLS *tls.ConnectionState
+	// Request is the upgrade request of WS connections, nil otherwise.
+	Request *http.Request
+}
+
+// AdmitFunc decides whether a connection is accepted. A non-nil error
+// rejects it; a *Rejection error with a Message sends that message to the
+// peer as a final frame before the connection is closed.
+type AdmitFunc func(remoteAddr net.Addr, meta *AdmitMeta) error
+
+// Rejection is an admission error carrying a final message for the peer.
+type Rejection struct {
+	Err     error
+	Message []byte
+}
+
+// Reject returns a Rejection of err which sends msg before closing.
+func Reject(err error, msg []byte) *Rejection {
+	return &Rejection{Err: err, Message: msg}
+}
+
+func (r *Rejection) Error() string {
+	return r.Err.Error()
+}
+
+func (r *Rejection) Unwrap() error {
+	return r.Err
+}
+
+// rejectMessage returns the final message of a rejection error, if any.
+func rejectMessage(err error) []byte {
+	var r *Rejection
+	if errors.As(err, &r) {
+		return r.Message
+	}
+	return nil
+}
+
+// AdmissionFilter admits connections by source IP. Its Admit method can be
+// used as the Admit hook of a server and every setting may be changed while
+// the server runs.
+type AdmissionFilter struct {
+	mu          sync.Mutex
+	allow       []*net.IPNet
+	deny        []*net.IPNet
+	bans        map[string]time.Time
+	maintenance atomic.Bool
+
+	// Final messages sent to rejected peers, nil closes silently.
+	DenyMessage        []byte
+	BanMessage         []byte
+	MaintenanceMessage []byte
+}
+
+func NewAdmissionFilter() *AdmissionFilter {
+	return &AdmissionFilter{
+		bans: make(map[string]time.Time),
+	}
+}
+
+// parseCIDR accepts CIDR notation or a single IP address.
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip %q", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+			bits = 8 * net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(s)
+	return ipNet, err
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, s := range cidrs {
+		ipNet, err := parseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetAllow replaces the allow list. When it is not empty only addresses in
+// one of the networks are admitted.
+func (f *AdmissionFilter) SetAllow(cidrs ...string) error {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.allow = nets
+	f.mu.Unlock()
+	return nil
+}
+
+// SetDeny replaces the deny list. It takes precedence over the allow list.
+func (f *AdmissionFilter) SetDeny(cidrs ...string) error {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.deny = nets
+	f.mu.Unlock()
+	return nil
+}
+
+// Ban rejects ip for d, forever when d is zero.
+func (f *AdmissionFilter) Ban(ip string, d time.Duration) error {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return fmt.Errorf("invalid ip %q", ip)
+	}
+	var until time.Time
+	if d > 0 {
+		until = time.Now().Add(d)
+	}
+	f.mu.Lock()
+	f.bans[parsed.String()] = until
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *AdmissionFilter) Unban(ip string) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return
+	}
+	f.mu.Lock()
+	delete(f.bans, parsed.String())
+	f.mu.Unlock()
+}
+
+// Banned reports whether ip is currently banned.
+func (f *AdmissionFilter) Banned(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.banned(parsed.String(), time.Now())
+}
+
+// banned checks and expires the ban of key, f.mu must be held.
+func (f *AdmissionFilter) banned(key string, now time.Time) bool {
+	until, ok := f.bans[key]
+	if !ok {
+		return false
+	}
+	if !until.IsZero() && now.After(until) {
+		delete(f.bans, key)
+		return false
+	}
+	return true
+}
+
+// SetMaintenance turns maintenance mode on or off. Every new connection
+// is rejected while it is on.
+func (f *AdmissionFilter) SetMaintenance(on bool) {
+	f.maintenance.Store(on)
+}
+
+func (f *AdmissionFilter) Maintenance() bool {
+	return f.maintenance.Load()
+}
+
+// Admit implements AdmitFunc.
+func (f *AdmissionFilter) Admit(remoteAddr net.Addr, _ *AdmitMeta) error {
+	if f.maintenance.Load() {
+		return Reject(ErrMaintenance, f.MaintenanceMessage)
+	}
+
+	var ip net.IP
+	switch a := remoteAddr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		// unix sockets and the like have no IP to filter on
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.banned(ip.String(), time.Now()) {
+		return Reject(ErrBanned, f.BanMessage)
+	}
+	if containsIP(f.deny, ip) {
+		return Reject(ErrDenied, f.DenyMessage)
+	}
+	if len(f.allow) > 0 && !containsIP(f.allow, ip) {
+		return Reject(ErrDenied, f.DenyMessage)
+	}
+	return nil
+}
+
+// reject sends the final message of err, if any, and closes conn.
+func (server *TCPServer) reject(conn net.Conn, err error) {
+	defer conn.Close()
+	log.Debug("reject %v: %v", conn.RemoteAddr(), err)
+	metricsOrNop(server.Metrics).ConnRejected()
+
+	msg := rejectMessage(err)
+	if msg == nil {
+		return
+	}
+	frame, err := server.msgParser.PackMsg(msg)
+	if err != nil {
+		log.Debug("pack reject message error: %v", err)
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+	conn.Write(frame)
+}
+
+// rejectEarly rejects conn before its handshake. The handshake only runs,
+// under rejectHandshakeTimeout, when a final message has to be sent through
+// TLS or the Handshake hook.
+func (server *TCPServer) rejectEarly(conn net.Conn, err error) {
+	if rejectMessage(err) != nil && (server.TLSConfig != nil || server.Handshake != nil) {
+		conn.SetDeadline(time.Now().Add(rejectHandshakeTimeout))
+		wrapped, herr := server.handshake(conn)
+		if herr != nil {
+			log.Debug("handshake with rejected %v error: %v", conn.RemoteAddr(), herr)
+			server.reject(conn, Reject(err, nil))
+			return
+		}
+		conn = wrapped
+	}
+	server.reject(conn, err)
+}
+
+// reject sends the final message of err, if any, then a close frame telling
+// why, and closes conn.
+func (handler *WSHandler) reject(conn *websocket.Conn, err error) {
+	defer conn.Close()
+	log.Debug("reject %v: %v", conn.RemoteAddr(), err)
+	metricsOrNop(handler.opts.Metrics).ConnRejected()
+
+	deadline := time.Now().Add(rejectWriteTimeout)
+	reason := err.Error()
+	if msg := rejectMessage(err); msg != nil {
+		conn.SetWriteDeadline(deadline)
+		if conn.WriteMessage(websocket.BinaryMessage, msg) != nil {
+			return
+		}
+		if utf8.Valid(msg) {
+			reason = string(msg)
+		}
+	}
+	data := websocket.FormatCloseMessage(rejectCloseCode(err), truncateText(reason, maxCloseText))
+	conn.WriteControl(websocket.CloseMessage, data, deadline)
+}
+
+// rejectCloseCode is the close code of a rejection: 1013 when the peer may
+// try again later, 1008 otherwise.
+func rejectCloseCode(err error) int {
+	if errors.Is(err, ErrServerFull) || errors.Is(err, ErrMaintenance) {
+		return websocket.CloseTryAgainLater
+	}
+	return websocket.ClosePolicyViolation
+}
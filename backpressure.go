@@ -0,0 +1,302 @@
+package netlib
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gzjjyz/netlib/log"
+	"github.com/gzjjyz/netlib/metrics"
+)
+
+// BackpressurePolicy decides what happens to a write when the write queue
+// of a connection is full.
+type BackpressurePolicy int
+
+const (
+	// BackpressureDisconnect destroys the connection.
+	BackpressureDisconnect BackpressurePolicy = iota
+	// BackpressureBlock waits for room, up to BlockTimeout.
+	BackpressureBlock
+	// BackpressureDropNewest discards the message being written.
+	BackpressureDropNewest
+	// BackpressureDropOldest discards queued messages to make room.
+	BackpressureDropOldest
+)
+
+func (p BackpressurePolicy) String() string {
+	switch p {
+	case BackpressureDisconnect:
+		return "disconnect"
+	case BackpressureBlock:
+		return "block"
+	case BackpressureDropNewest:
+		return "drop-newest"
+	case BackpressureDropOldest:
+		return "drop-oldest"
+	}
+	return "unknown"
+}
+
+type BackpressureOptions struct {
+	Policy BackpressurePolicy
+	// BlockTimeout bounds BackpressureBlock waits, zero waits until the
+	// connection closes.
+	BlockTimeout time.Duration
+	// MaxQueueBytes limits the bytes queued for writing, zero means no limit.
+	// A single message larger than the limit is still queued when the
+	// queue is empty.
+	MaxQueueBytes int
+}
+
+// frame is a queued message, written as the concatenation of its parts.
+// The first part of WS frames holds the message type. A nil frame asks the
+// writer goroutine to close the connection.
+type frame [][]byte
+
+func (f frame) size() int {
+	n := 0
+	for _, b := range f {
+		n += len(b)
+	}
+	return n
+}
+
+// queueOwner is the connection of a writeQueue. Its lock serializes push
+// and close.
+type queueOwner interface {
+	sync.Locker
+	// closed reports whether the connection is closed, called with the
+	// lock held
+	closed() bool
+	// doDestroy destroys the connection, called with the lock held
+	doDestroy()
+}
+
+// writeQueue is the buffer between writers of a connection and its writer
+// goroutine. Callers serialize push and close.
+type writeQueue struct {
+	ch    chan frame
+	bytes atomic.Int64
+	// space is closed when a message is taken off the queue while writers
+	// wait for room
+	space   chan struct{}
+	spaceMu sync.Mutex
+	waiters atomic.Int32
+	// heartbeat is the only part of heartbeat frames, which batch counts
+	// apart from messages
+	heartbeat []byte
+	opts      BackpressureOptions
+	metrics   metrics.Metrics
+}
+
+func newWriteQueue(capacity int, opts BackpressureOptions, m metrics.Metrics) *writeQueue {
+	return &writeQueue{
+		ch:      make(chan frame, capacity),
+		opts:    opts,
+		metrics: m,
+	}
+}
+
+func (q *writeQueue) full(n int) bool {
+	if len(q.ch) == cap(q.ch) {
+		return true
+	}
+	queued := q.bytes.Load()
+	return q.opts.MaxQueueBytes > 0 && queued > 0 && queued+int64(n) > int64(q.opts.MaxQueueBytes)
+}
+
+func (q *writeQueue) enqueue(f frame) {
+	q.bytes.Add(int64(f.size()))
+	q.metrics.QueueDepth(1)
+	q.ch <- f
+}
+
+// dequeued must be called by the writer goroutine for every message it
+// takes off the queue.
+func (q *writeQueue) dequeued(f frame) {
+	q.bytes.Add(-int64(f.size()))
+	q.metrics.QueueDepth(-1)
+	if q.waiters.Load() > 0 {
+		q.spaceMu.Lock()
+		if q.space != nil {
+			close(q.space)
+			q.space = nil
+		}
+		q.spaceMu.Unlock()
+	}
+}
+
+// waitSpace returns a channel closed once a message is taken off the queue.
+func (q *writeQueue) waitSpace() <-chan struct{} {
+	q.spaceMu.Lock()
+	defer q.spaceMu.Unlock()
+	if q.space == nil {
+		q.space = make(chan struct{})
+	}
+	return q.space
+}
+
+// push queues f according to the policy. It is called with the lock of
+// owner held, see waitRoom. done is closed once the writer goroutine exits.
+func (q *writeQueue) push(f frame, owner queueOwner, done <-chan struct{}) error {
+	n := f.size()
+	if !q.full(n) {
+		q.enqueue(f)
+		return nil
+	}
+
+	switch q.opts.Policy {
+	case BackpressureBlock:
+		var timeout <-chan time.Time
+		if q.opts.BlockTimeout > 0 {
+			timer := time.NewTimer(q.opts.BlockTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		if err := q.waitRoom(n, owner, done, nil, timeout); err != nil {
+			return err
+		}
+		q.enqueue(f)
+		return nil
+	case BackpressureDropNewest:
+		return ErrQueueFull
+	case BackpressureDropOldest:
+		for q.full(n) {
+			select {
+			case old := <-q.ch:
+				q.dequeued(old)
+			default:
+				// the writer goroutine drained the queue meanwhile
+			}
+		}
+		q.enqueue(f)
+		return nil
+	default:
+		log.Warn("close conn: write queue full")
+		q.metrics.QueueFullDestroy()
+		owner.doDestroy()
+		return ErrQueueFull
+	}
+}
+
+// waitRoom waits until n bytes fit in the queue. It is called with the lock
+// of owner held and releases it while waiting, so that other writers, Close
+// and Destroy go on meanwhile. It returns ErrConnClosed when the connection
+// closes first and ErrQueueFull when timeout fires or cancel is closed.
+func (q *writeQueue) waitRoom(n int, owner queueOwner, done, cancel <-chan struct{}, timeout <-chan time.Time) error {
+	for {
+		q.waiters.Add(1)
+		space := q.waitSpace()
+		if !q.full(n) {
+			q.waiters.Add(-1)
+			return nil
+		}
+
+		owner.Unlock()
+		var err error
+		select {
+		case <-space:
+		case <-done:
+			err = ErrConnClosed
+		case <-cancel:
+			err = ErrQueueFull
+		case <-timeout:
+			err = ErrQueueFull
+		}
+		owner.Lock()
+		q.waiters.Add(-1)
+		if err != nil {
+			return err
+		}
+		if owner.closed() {
+			return ErrConnClosed
+		}
+	}
+}
+
+// tryPush queues f only if there is room, regardless of the policy.
+func (q *writeQueue) tryPush(f frame) bool {
+	if len(q.ch) == cap(q.ch) {
+		return false
+	}
+	q.enqueue(f)
+	return true
+}
+
+func (q *writeQueue) close() {
+	close(q.ch)
+}
+
+// drain discards what is left once the writer goroutine has stopped.
+func (q *writeQueue) drain() {
+	for {
+		select {
+		case f, ok := <-q.ch:
+			if !ok {
+				return
+			}
+			q.dequeued(f)
+		default:
+			return
+		}
+	}
+}
+
+func (q *writeQueue) isHeartbeat(f frame) bool {
+	return len(f) == 1 && len(f[0]) > 0 && len(q.heartbeat) > 0 && &f[0][0] == &q.heartbeat[0]
+}
+
+// batch appends f and the frames queued behind it to vec until maxBytes
+// is reached, waiting up to delay for more when it is positive. msgs does
+// not count the heartbeat frames, beats does. stop reports that the close
+// sentinel was taken or the queue was closed.
+func (q *writeQueue) batch(vec [][]byte, f frame, maxBytes int, delay time.Duration) (out [][]byte, msgs, beats int, stop bool) {
+	var n int
+	add := func(f frame) {
+		vec = append(vec, f...)
+		n += f.size()
+		if q.isHeartbeat(f) {
+			beats++
+		} else {
+			msgs++
+		}
+	}
+	add(f)
+
+	var timeout <-chan time.Time
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for n < maxBytes {
+		var ok bool
+		select {
+		case f, ok = <-q.ch:
+		default:
+			if timeout == nil {
+				return vec, msgs, beats, false
+			}
+			select {
+			case f, ok = <-q.ch:
+			case <-timeout:
+				return vec, msgs, beats, false
+			}
+		}
+		if !ok {
+			return vec, msgs, beats, true
+		}
+		q.dequeued(f)
+		if f == nil {
+			return vec, msgs, beats, true
+		}
+		add(f)
+	}
+	return vec, msgs, beats, false
+}
+
+func (q *writeQueue) len() int {
+	return len(q.ch)
+}
@@ -0,0 +1,61 @@
+// Package bufpool pools byte slices by power-of-two size classes.
+package bufpool
+
+import (
+	"math/bits"
+	"sync"
+)
+
+const (
+	minShift = 6  // 64 B
+	maxShift = 16 // 64 KiB
+)
+
+var (
+	classes [maxShift - minShift + 1]sync.Pool
+	// headers recycles the *[]byte wrappers so Put does not allocate
+	headers = sync.Pool{New: func() any { return new([]byte) }}
+)
+
+// class returns the index of the smallest class holding n bytes, or -1
+// when n is larger than every class.
+func class(n int) int {
+	if n <= 1<<minShift {
+		return 0
+	}
+	shift := bits.Len(uint(n - 1))
+	if shift > maxShift {
+		return -1
+	}
+	return shift - minShift
+}
+
+// Get returns a slice of length n. Its capacity is rounded up to the size
+// class, requests over 64 KiB are allocated directly.
+func Get(n int) []byte {
+	c := class(n)
+	if c < 0 {
+		return make([]byte, n)
+	}
+
+	if p, ok := classes[c].Get().(*[]byte); ok {
+		b := *p
+		*p = nil
+		headers.Put(p)
+		return b[:n]
+	}
+	return make([]byte, n, 1<<(c+minShift))
+}
+
+// Put returns b to the pool. b must not be used afterwards. Slices whose
+// capacity is not a size class are dropped.
+func Put(b []byte) {
+	c := class(cap(b))
+	if c < 0 || cap(b) != 1<<(c+minShift) {
+		return
+	}
+
+	p := headers.Get().(*[]byte)
+	*p = b[:0]
+	classes[c].Put(p)
+}
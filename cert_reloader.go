@@ -0,0 +1,140 @@
+package netlib
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CertReloader serves a certificate key pair loaded from disk and swaps it
+// when the files change, without restarting the listener. Plug it into any
+// tls.Config through GetCertificate, or use TLSConfig.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Pointer[tls.Certificate]
+
+	mu       sync.Mutex
+	lastSeen [2]fileStamp
+	stop     chan struct{}
+
+	// OnError is called when a reload triggered by Watch fails. The
+	// previous certificate stays in service.
+	OnError func(err error)
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func stampOf(name string) fileStamp {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+}
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the key pair from disk. On error the previous certificate
+// stays in service.
+func (r *CertReloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reload()
+}
+
+func (r *CertReloader) reload() error {
+	r.lastSeen = [2]fileStamp{stampOf(r.certFile), stampOf(r.keyFile)}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert.Store(&cert)
+	return nil
+}
+
+func (r *CertReloader) Certificate() *tls.Certificate {
+	return r.cert.Load()
+}
+
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// TLSConfig returns a server config serving the current certificate.
+func (r *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: r.GetCertificate,
+	}
+}
+
+// Watch polls the files every interval and reloads the key pair when
+// either of them changes. It stops when Close is called.
+func (r *CertReloader) Watch(interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("invalid watch interval %v", interval)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stop != nil {
+		return nil
+	}
+	r.stop = make(chan struct{})
+
+	go r.watch(interval, r.stop)
+	return nil
+}
+
+func (r *CertReloader) watch(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		r.mu.Lock()
+		var err error
+		if seen := [2]fileStamp{stampOf(r.certFile), stampOf(r.keyFile)}; seen != r.lastSeen {
+			err = r.reload()
+		}
+		r.mu.Unlock()
+
+		if err != nil && r.OnError != nil {
+			r.OnError(err)
+		}
+	}
+}
+
+func (r *CertReloader) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+}
@@ -0,0 +1,19 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Codec serializes payload values carried by a Conn.
+type Codec interface {
+	Name() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var ErrUnsupportedType = errors.New("unsupported type")
+
+func unsupported(c Codec, v any) error {
+	return fmt.Errorf("%w: %s codec cannot handle %T", ErrUnsupportedType, c.Name(), v)
+}
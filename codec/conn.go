@@ -0,0 +1,62 @@
+package codec
+
+import (
+	"errors"
+
+	"github.com/gzjjyz/netlib"
+	"github.com/gzjjyz/netlib/parser"
+)
+
+// Conn wraps a netlib.Conn and moves values through a Codec.
+type Conn struct {
+	netlib.Conn
+	codec Codec
+	opts  *parser.Option
+}
+
+func NewConn(conn netlib.Conn, codec Codec, opts *parser.Option) (*Conn, error) {
+	if conn == nil {
+		return nil, errors.New("conn must not be nil")
+	}
+	if codec == nil {
+		return nil, errors.New("codec must not be nil")
+	}
+	if opts == nil {
+		opts = parser.DefaultOption()
+	}
+	if err := opts.Validation(); err != nil {
+		return nil, err
+	}
+
+	return &Conn{
+		Conn:  conn,
+		codec: codec,
+		opts:  opts,
+	}, nil
+}
+
+func (c *Conn) Codec() Codec {
+	return c.codec
+}
+
+func (c *Conn) WriteValue(v any) error {
+	data, err := c.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err = c.opts.CheckMsgLen(uint32(len(data))); err != nil {
+		return err
+	}
+	return c.Conn.WriteMsg(data)
+}
+
+func (c *Conn) ReadValue(v any) error {
+	data, err := c.Conn.ReadMsg()
+	if err != nil {
+		return err
+	}
+	if err = c.opts.CheckMsgLen(uint32(len(data))); err != nil {
+		return err
+	}
+	return c.codec.Unmarshal(data, v)
+}
@@ -0,0 +1,37 @@
+package codec
+
+import "github.com/vmihailenco/msgpack/v5"
+
+// MsgpackMarshaler and MsgpackUnmarshaler match the methods generated by
+// tinylib/msgp.
+type MsgpackMarshaler interface {
+	MarshalMsg(b []byte) ([]byte, error)
+}
+
+type MsgpackUnmarshaler interface {
+	UnmarshalMsg(b []byte) ([]byte, error)
+}
+
+// Msgpack is a Codec for any value msgpack can encode, e.g. structs with
+// `msgpack` tags. Values generated by tinylib/msgp use their generated
+// methods instead.
+type Msgpack struct{}
+
+func (Msgpack) Name() string {
+	return "msgpack"
+}
+
+func (c Msgpack) Marshal(v any) ([]byte, error) {
+	if m, ok := v.(MsgpackMarshaler); ok {
+		return m.MarshalMsg(nil)
+	}
+	return msgpack.Marshal(v)
+}
+
+func (c Msgpack) Unmarshal(data []byte, v any) error {
+	if m, ok := v.(MsgpackUnmarshaler); ok {
+		_, err := m.UnmarshalMsg(data)
+		return err
+	}
+	return msgpack.Unmarshal(data, v)
+}
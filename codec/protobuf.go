@@ -0,0 +1,38 @@
+package codec
+
+import "google.golang.org/protobuf/proto"
+
+// ProtoMessage is implemented by messages generated with gogoproto or
+// vtprotobuf style plugins, which emit Marshal/Unmarshal methods.
+type ProtoMessage interface {
+	Marshal() ([]byte, error)
+	Unmarshal(data []byte) error
+}
+
+// Protobuf is a Codec for proto.Message values. Values implementing
+// ProtoMessage use their generated methods instead.
+type Protobuf struct{}
+
+func (Protobuf) Name() string {
+	return "protobuf"
+}
+
+func (c Protobuf) Marshal(v any) ([]byte, error) {
+	switch m := v.(type) {
+	case ProtoMessage:
+		return m.Marshal()
+	case proto.Message:
+		return proto.Marshal(m)
+	}
+	return nil, unsupported(c, v)
+}
+
+func (c Protobuf) Unmarshal(data []byte, v any) error {
+	switch m := v.(type) {
+	case ProtoMessage:
+		return m.Unmarshal(data)
+	case proto.Message:
+		return proto.Unmarshal(data, m)
+	}
+	return unsupported(c, v)
+}
@@ -1,7 +1,14 @@
 package netlib
 
 import (
+	"errors"
 	"net"
+	"sync/atomic"
+)
+
+var (
+	ErrConnClosed = errors.New("connection closed")
+	ErrQueueFull  = errors.New("write queue full")
 )
 
 type Conn interface {
@@ -12,3 +19,25 @@ type Conn interface {
 	Close()
 	Destroy()
 }
+
+// closeCause keeps the first error that ended a connection.
+type closeCause struct {
+	v atomic.Value
+}
+
+type causeBox struct {
+	err error
+}
+
+func (c *closeCause) set(err error) {
+	if err != nil {
+		c.v.CompareAndSwap(nil, causeBox{err})
+	}
+}
+
+func (c *closeCause) get() error {
+	if b, ok := c.v.Load().(causeBox); ok {
+		return b.err
+	}
+	return nil
+}
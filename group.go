@@ -0,0 +1,148 @@
+package netlib
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// frameWriter is implemented by connections whose packed frames can be
+// shared by several recipients. Connections with equal frame keys produce
+// identical frames for the same message.
+type frameWriter interface {
+	frameKey() any
+	packFrame(args ...[]byte) (frame, error)
+	writeFrame(f frame) error
+}
+
+// SendError reports a failed delivery to one member of a Group.
+type SendError struct {
+	Conn Conn
+	Err  error
+}
+
+func (e *SendError) Error() string {
+	return fmt.Sprintf("send to %v: %v", e.Conn.RemoteAddr(), e.Err)
+}
+
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+// Group is a set of connections sharing broadcasts, e.g. a room. Members
+// found closed by a broadcast leave the group; call Leave in OnClose to
+// drop the others right away.
+type Group struct {
+	mu      sync.RWMutex
+	members map[Conn]struct{}
+}
+
+func NewGroup() *Group {
+	return &Group{
+		members: make(map[Conn]struct{}),
+	}
+}
+
+// Join adds conn to the group and reports whether it was not a member yet.
+func (g *Group) Join(conn Conn) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.members[conn]; ok {
+		return false
+	}
+	g.members[conn] = struct{}{}
+	return true
+}
+
+// Leave removes conn from the group and reports whether it was a member.
+func (g *Group) Leave(conn Conn) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.members[conn]; !ok {
+		return false
+	}
+	delete(g.members, conn)
+	return true
+}
+
+func (g *Group) Has(conn Conn) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	_, ok := g.members[conn]
+	return ok
+}
+
+func (g *Group) Len() int {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return len(g.members)
+}
+
+func (g *Group) Members() []Conn {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	conns := make([]Conn, 0, len(g.members))
+	for conn := range g.members {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// Broadcast writes the message to every member. The frame is packed once
+// per kind of connection and the same buffer is queued for every
+// recipient. Failed deliveries are returned, they do not stop the fan-out.
+// Members failing with ErrConnClosed leave the group.
+// args must not be modified by the others goroutines
+func (g *Group) Broadcast(args ...[]byte) []*SendError {
+	return g.BroadcastExcept(nil, args...)
+}
+
+// BroadcastExcept is like Broadcast but skips except.
+func (g *Group) BroadcastExcept(except Conn, args ...[]byte) []*SendError {
+	errs := Broadcast(g.Members(), except, args...)
+	for _, err := range errs {
+		if errors.Is(err.Err, ErrConnClosed) {
+			g.Leave(err.Conn)
+		}
+	}
+	return errs
+}
+
+type packedFrame struct {
+	parts frame
+	err   error
+}
+
+// Broadcast writes the message to every conn but except, see Group.Broadcast.
+func Broadcast(conns []Conn, except Conn, args ...[]byte) []*SendError {
+	var errs []*SendError
+	frames := make(map[any]packedFrame, 2)
+
+	for _, conn := range conns {
+		if conn == except {
+			continue
+		}
+
+		var err error
+		if fw, ok := conn.(frameWriter); ok {
+			key := fw.frameKey()
+			packed, ok := frames[key]
+			if !ok {
+				packed.parts, packed.err = fw.packFrame(args...)
+				frames[key] = packed
+			}
+
+			err = packed.err
+			if err == nil {
+				err = fw.writeFrame(packed.parts)
+			}
+		} else {
+			err = conn.WriteMsg(args...)
+		}
+
+		if err != nil {
+			errs = append(errs, &SendError{Conn: conn, Err: err})
+		}
+	}
+	return errs
+}
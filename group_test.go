@@ -0,0 +1,62 @@
+package netlib
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// fakeConn records written messages, or fails every write with err.
+type fakeConn struct {
+	err  error
+	msgs [][]byte
+}
+
+func (c *fakeConn) ReadMsg() ([]byte, error) { return nil, ErrConnClosed }
+func (c *fakeConn) LocalAddr() net.Addr      { return nil }
+func (c *fakeConn) RemoteAddr() net.Addr     { return nil }
+func (c *fakeConn) Close()                   {}
+func (c *fakeConn) Destroy()                 {}
+
+func (c *fakeConn) WriteMsg(args ...[]byte) error {
+	if c.err != nil {
+		return c.err
+	}
+	var msg []byte
+	for _, arg := range args {
+		msg = append(msg, arg...)
+	}
+	c.msgs = append(c.msgs, msg)
+	return nil
+}
+
+func TestGroupBroadcast(t *testing.T) {
+	live := &fakeConn{}
+	closed := &fakeConn{err: ErrConnClosed}
+	full := &fakeConn{err: ErrQueueFull}
+	g := NewGroup()
+	for _, conn := range []Conn{live, closed, full} {
+		g.Join(conn)
+	}
+
+	errs := g.Broadcast([]byte("hi"))
+	if len(errs) != 2 {
+		t.Fatalf("%d errors, want 2", len(errs))
+	}
+	for _, err := range errs {
+		var se *SendError
+		if !errors.As(error(err), &se) {
+			t.Errorf("%v is not a *SendError", err)
+		}
+	}
+	if len(live.msgs) != 1 || string(live.msgs[0]) != "hi" {
+		t.Errorf("live member got %q", live.msgs)
+	}
+
+	if g.Has(closed) {
+		t.Error("closed member still in the group")
+	}
+	if !g.Has(full) || !g.Has(live) {
+		t.Error("open members left the group")
+	}
+}
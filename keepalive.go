@@ -0,0 +1,47 @@
+package netlib
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// KeepAliveOptions detects half-dead peers. Zero values disable each check.
+type KeepAliveOptions struct {
+	// ReadIdleTimeout declares the peer dead when nothing arrives for this long.
+	ReadIdleTimeout time.Duration
+	// WriteIdleTimeout declares the peer dead when a single write blocks for this long.
+	WriteIdleTimeout time.Duration
+	// HeartbeatInterval sends a ping after the connection has been write idle
+	// for this long. TCP pings are zero-length frames and require
+	// parser.Option.Heartbeat; WebSocket uses native ping control frames.
+	HeartbeatInterval time.Duration
+	// OnDead is called once when the peer of conn is declared dead.
+	OnDead func(conn Conn, err error)
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// idleTimer calls ping whenever the time since the last write, as reported
+// by lastWrite, reaches interval. It returns when done is closed.
+func idleTimer(interval time.Duration, lastWrite func() time.Time, ping func(), done <-chan struct{}) {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-timer.C:
+			idle := now.Sub(lastWrite())
+			if idle >= interval {
+				ping()
+				idle = 0
+			}
+			timer.Reset(interval - idle)
+		}
+	}
+}
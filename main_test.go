@@ -0,0 +1,21 @@
+package netlib
+
+import (
+	"os"
+	"testing"
+
+	"github.com/gzjjyz/netlib/log"
+)
+
+type nopLogger struct{}
+
+func (nopLogger) LogDebug(string, ...interface{}) {}
+func (nopLogger) LogInfo(string, ...interface{})  {}
+func (nopLogger) LogWarn(string, ...interface{})  {}
+func (nopLogger) LogError(string, ...interface{}) {}
+func (nopLogger) LogFatal(string, ...interface{}) {}
+
+func TestMain(m *testing.M) {
+	log.SetLogger(nopLogger{})
+	os.Exit(m.Run())
+}
@@ -0,0 +1,42 @@
+package metrics
+
+// Metrics receives connection events from a server. Implementations must
+// be safe for concurrent use.
+type Metrics interface {
+	// ConnAccepted counts connections accepted by the listener.
+	ConnAccepted()
+	// ConnRejected counts connections turned away because of MaxConnNum or
+	// by the admission hook.
+	ConnRejected()
+	// ConnOpened and ConnClosed track the active connections.
+	ConnOpened()
+	ConnClosed()
+	BytesIn(n int)
+	BytesOut(n int)
+	MsgIn()
+	MsgOut()
+	// QueueDepth adjusts the number of messages waiting in write queues.
+	QueueDepth(delta int)
+	// QueueFullDestroy counts connections destroyed because their write queue was full.
+	QueueFullDestroy()
+	// ParseError counts inbound frames rejected by the message length checks.
+	ParseError()
+	// RateLimited counts violations of the rate limit named kind.
+	RateLimited(kind string)
+}
+
+// Nop discards every event.
+type Nop struct{}
+
+func (Nop) ConnAccepted()      {}
+func (Nop) ConnRejected()      {}
+func (Nop) ConnOpened()        {}
+func (Nop) ConnClosed()        {}
+func (Nop) BytesIn(int)        {}
+func (Nop) BytesOut(int)       {}
+func (Nop) MsgIn()             {}
+func (Nop) MsgOut()            {}
+func (Nop) QueueDepth(int)     {}
+func (Nop) QueueFullDestroy()  {}
+func (Nop) ParseError()        {}
+func (Nop) RateLimited(string) {}
@@ -0,0 +1,166 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Collector is a Metrics implementation backed by atomic counters.
+type Collector struct {
+	name string
+
+	accepted         atomic.Int64
+	rejected         atomic.Int64
+	active           atomic.Int64
+	bytesIn          atomic.Int64
+	bytesOut         atomic.Int64
+	msgsIn           atomic.Int64
+	msgsOut          atomic.Int64
+	queueDepth       atomic.Int64
+	queueFullDestroy atomic.Int64
+	parseErrors      atomic.Int64
+
+	mu          sync.Mutex
+	rateLimited map[string]*atomic.Int64
+}
+
+func (c *Collector) Name() string {
+	return c.name
+}
+
+func (c *Collector) ConnAccepted()        { c.accepted.Add(1) }
+func (c *Collector) ConnRejected()        { c.rejected.Add(1) }
+func (c *Collector) ConnOpened()          { c.active.Add(1) }
+func (c *Collector) ConnClosed()          { c.active.Add(-1) }
+func (c *Collector) BytesIn(n int)        { c.bytesIn.Add(int64(n)) }
+func (c *Collector) BytesOut(n int)       { c.bytesOut.Add(int64(n)) }
+func (c *Collector) MsgIn()               { c.msgsIn.Add(1) }
+func (c *Collector) MsgOut()              { c.msgsOut.Add(1) }
+func (c *Collector) QueueDepth(delta int) { c.queueDepth.Add(int64(delta)) }
+func (c *Collector) QueueFullDestroy()    { c.queueFullDestroy.Add(1) }
+func (c *Collector) ParseError()          { c.parseErrors.Add(1) }
+
+func (c *Collector) RateLimited(kind string) {
+	c.mu.Lock()
+	counter, ok := c.rateLimited[kind]
+	if !ok {
+		if c.rateLimited == nil {
+			c.rateLimited = make(map[string]*atomic.Int64)
+		}
+		counter = new(atomic.Int64)
+		c.rateLimited[kind] = counter
+	}
+	c.mu.Unlock()
+
+	counter.Add(1)
+}
+
+// rateLimitedCounts returns the violation counts sorted by kind.
+func (c *Collector) rateLimitedCounts() ([]string, []int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	kinds := make([]string, 0, len(c.rateLimited))
+	for kind := range c.rateLimited {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	counts := make([]int64, len(kinds))
+	for i, kind := range kinds {
+		counts[i] = c.rateLimited[kind].Load()
+	}
+	return kinds, counts
+}
+
+type metricDesc struct {
+	name  string
+	kind  string
+	help  string
+	value func(c *Collector) int64
+}
+
+var descs = []metricDesc{
+	{"netlib_connections_accepted_total", "counter", "Connections accepted by the listener.", func(c *Collector) int64 { return c.accepted.Load() }},
+	{"netlib_connections_rejected_total", "counter", "Connections rejected by MaxConnNum or the admission hook.", func(c *Collector) int64 { return c.rejected.Load() }},
+	{"netlib_connections_active", "gauge", "Connections currently open.", func(c *Collector) int64 { return c.active.Load() }},
+	{"netlib_bytes_in_total", "counter", "Bytes read from connections.", func(c *Collector) int64 { return c.bytesIn.Load() }},
+	{"netlib_bytes_out_total", "counter", "Bytes written to connections.", func(c *Collector) int64 { return c.bytesOut.Load() }},
+	{"netlib_messages_in_total", "counter", "Messages read from connections.", func(c *Collector) int64 { return c.msgsIn.Load() }},
+	{"netlib_messages_out_total", "counter", "Messages written to connections.", func(c *Collector) int64 { return c.msgsOut.Load() }},
+	{"netlib_write_queue_depth", "gauge", "Messages waiting in write queues.", func(c *Collector) int64 { return c.queueDepth.Load() }},
+	{"netlib_queue_full_destroys_total", "counter", "Connections destroyed because their write queue was full.", func(c *Collector) int64 { return c.queueFullDestroy.Load() }},
+	{"netlib_parse_errors_total", "counter", "Inbound frames rejected by message length checks.", func(c *Collector) int64 { return c.parseErrors.Load() }},
+}
+
+// Registry holds one Collector per server and renders them in the
+// Prometheus text exposition format.
+type Registry struct {
+	mu         sync.Mutex
+	collectors map[string]*Collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		collectors: make(map[string]*Collector),
+	}
+}
+
+// Collector returns the collector labelled server=name, creating it on first use.
+func (r *Registry) Collector(name string) *Collector {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.collectors[name]
+	if !ok {
+		c = &Collector{name: name}
+		r.collectors[name] = c
+	}
+	return c
+}
+
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	collectors := make([]*Collector, 0, len(r.collectors))
+	for _, c := range r.collectors {
+		collectors = append(collectors, c)
+	}
+	r.mu.Unlock()
+	sort.Slice(collectors, func(i, j int) bool { return collectors[i].name < collectors[j].name })
+
+	var sb strings.Builder
+	for _, d := range descs {
+		fmt.Fprintf(&sb, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, d.kind)
+		for _, c := range collectors {
+			fmt.Fprintf(&sb, "%s{server=\"%s\"} %d\n", d.name, escapeLabel(c.name), d.value(c))
+		}
+	}
+
+	const rateLimited = "netlib_rate_limited_total"
+	fmt.Fprintf(&sb, "# HELP %s Rate limit violations.\n# TYPE %s counter\n", rateLimited, rateLimited)
+	for _, c := range collectors {
+		kinds, counts := c.rateLimitedCounts()
+		for i, kind := range kinds {
+			fmt.Fprintf(&sb, "%s{server=\"%s\",kind=\"%s\"} %d\n", rateLimited, escapeLabel(c.name), escapeLabel(kind), counts[i])
+		}
+	}
+
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
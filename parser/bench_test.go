@@ -0,0 +1,67 @@
+package parser
+
+import (
+	"bufio"
+	"testing"
+)
+
+// loopReader replays a stream of frames forever and counts Read calls,
+// each of which would be a syscall on a socket.
+type loopReader struct {
+	data  []byte
+	off   int
+	calls int
+}
+
+func (r *loopReader) Read(b []byte) (int, error) {
+	r.calls++
+	n := copy(b, r.data[r.off:])
+	r.off = (r.off + n) % len(r.data)
+	return n, nil
+}
+
+func benchStream(b *testing.B, p *Parser, size, count int) []byte {
+	msg, err := p.PackMsg(make([]byte, size))
+	if err != nil {
+		b.Fatal(err)
+	}
+	var stream []byte
+	for i := 0; i < count; i++ {
+		stream = append(stream, msg...)
+	}
+	return stream
+}
+
+func benchRead(b *testing.B, size int, read func(p *Parser, r *loopReader) func() ([]byte, error)) {
+	p, err := NewMsgParser(DefaultOption())
+	if err != nil {
+		b.Fatal(err)
+	}
+	r := &loopReader{data: benchStream(b, p, size, 64)}
+	next := read(p, r)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := next(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(r.calls)/float64(b.N), "reads/op")
+}
+
+func unbufferedRead(p *Parser, r *loopReader) func() ([]byte, error) {
+	return func() ([]byte, error) { return p.Read(r) }
+}
+
+func bufferedReadInto(p *Parser, r *loopReader) func() ([]byte, error) {
+	br := bufio.NewReaderSize(r, 4096)
+	buf := make([]byte, 0, 4096)
+	return func() ([]byte, error) { return p.ReadInto(br, buf) }
+}
+
+func BenchmarkRead64(b *testing.B)       { benchRead(b, 64, unbufferedRead) }
+func BenchmarkReadInto64(b *testing.B)   { benchRead(b, 64, bufferedReadInto) }
+func BenchmarkRead1024(b *testing.B)     { benchRead(b, 1024, unbufferedRead) }
+func BenchmarkReadInto1024(b *testing.B) { benchRead(b, 1024, bufferedReadInto) }
@@ -0,0 +1,83 @@
+package parser
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Compression IDs written in the flag byte of a frame. 0 marks an
+// uncompressed body.
+const (
+	CompressNone   byte = 0
+	CompressFlate  byte = 1
+	CompressSnappy byte = 2
+	CompressZstd   byte = 3
+)
+
+// Compressor compresses frame bodies when Option.Compressor is set.
+type Compressor interface {
+	// ID identifies the algorithm on the wire and must not be CompressNone.
+	ID() byte
+	Compress(src []byte) ([]byte, error)
+	// Decompress must stop with ErrMsgTooLong as soon as the output
+	// exceeds maxLen bytes.
+	Decompress(src []byte, maxLen uint32) ([]byte, error)
+}
+
+// Flate is a Compressor backed by compress/flate.
+type Flate struct {
+	// Level is a compress/flate level, 0 selects flate.DefaultCompression.
+	Level int
+
+	writers sync.Pool
+}
+
+func (c *Flate) ID() byte {
+	return CompressFlate
+}
+
+func (c *Flate) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Grow(len(src) / 2)
+
+	w, _ := c.writers.Get().(*flate.Writer)
+	if w == nil {
+		level := c.Level
+		if level == 0 {
+			level = flate.DefaultCompression
+		}
+		var err error
+		if w, err = flate.NewWriter(&buf, level); err != nil {
+			return nil, err
+		}
+	} else {
+		w.Reset(&buf)
+	}
+	defer c.writers.Put(w)
+
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *Flate) Decompress(src []byte, maxLen uint32) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+
+	// read one byte past the limit to detect oversized output
+	out, err := io.ReadAll(io.LimitReader(r, int64(maxLen)+1))
+	if err != nil {
+		return nil, err
+	}
+	if uint32(len(out)) > maxLen {
+		return nil, fmt.Errorf("%w, decompressed size exceeded specified limit %d", ErrMsgTooLong, maxLen)
+	}
+	return out, nil
+}
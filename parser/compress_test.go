@@ -0,0 +1,103 @@
+package parser
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func compressors() map[string]func() Compressor {
+	return map[string]func() Compressor{
+		"flate":  func() Compressor { return &Flate{} },
+		"snappy": func() Compressor { return Snappy{} },
+		"zstd":   func() Compressor { return &Zstd{} },
+	}
+}
+
+func newCompressParser(t *testing.T, c Compressor, maxMsgLen, threshold uint32) *Parser {
+	t.Helper()
+	p, err := NewMsgParser(&Option{
+		LenMsgLen:         4,
+		MaxMsgLen:         maxMsgLen,
+		Compressor:        c,
+		CompressThreshold: threshold,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	for name, newCompressor := range compressors() {
+		t.Run(name, func(t *testing.T) {
+			p := newCompressParser(t, newCompressor(), 1<<20, 64)
+			msg := bytes.Repeat([]byte("netlib "), 1000)
+
+			frame, err := p.PackMsg(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if flag := frame[4]; flag != p.opts.Compressor.ID() {
+				t.Errorf("flag %d, want %d", flag, p.opts.Compressor.ID())
+			}
+			if len(frame) >= len(msg) {
+				t.Errorf("frame of %d bytes for a %d bytes message", len(frame), len(msg))
+			}
+
+			got, err := p.Read(bytes.NewReader(frame))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, msg) {
+				t.Error("message differs after the round trip")
+			}
+		})
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	for name, newCompressor := range compressors() {
+		t.Run(name, func(t *testing.T) {
+			// the peer accepts far larger messages than the reader
+			packer := newCompressParser(t, newCompressor(), 1<<21, 64)
+			reader := newCompressParser(t, newCompressor(), 64<<10, 64)
+
+			bomb, err := packer.PackMsg(make([]byte, 1<<20))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(bomb) > 64<<10 {
+				t.Fatalf("compressed frame of %d bytes is not under the limit", len(bomb))
+			}
+
+			if _, err := reader.Read(bytes.NewReader(bomb)); !errors.Is(err, ErrMsgTooLong) {
+				t.Errorf("error %v, want ErrMsgTooLong", err)
+			}
+		})
+	}
+}
+
+func TestCompressThreshold(t *testing.T) {
+	p := newCompressParser(t, &Flate{}, 1<<20, 1024)
+	msg := bytes.Repeat([]byte{'a'}, 1023)
+
+	frame, err := p.PackMsg(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flag := frame[4]; flag != CompressNone {
+		t.Errorf("flag %d under the threshold, want CompressNone", flag)
+	}
+	if !bytes.Equal(frame[5:], msg) {
+		t.Error("body under the threshold is not sent as is")
+	}
+
+	got, err := p.Read(bytes.NewReader(frame))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Error("message differs after the round trip")
+	}
+}
@@ -2,16 +2,30 @@ package parser
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"math"
 )
 
+var (
+	ErrMsgTooLong  = errors.New("message too long")
+	ErrMsgTooShort = errors.New("message too short")
+)
+
 type Option struct {
 	LenMsgLen    int
 	MinMsgLen    uint32
 	MaxMsgLen    uint32
 	LittleEndian bool
+	// Heartbeat reserves zero-length frames for heartbeats. They bypass
+	// MinMsgLen and cannot be produced by PackMsg.
+	Heartbeat bool
+	// Compressor adds a flag byte after the length prefix and compresses
+	// bodies of at least CompressThreshold bytes. MinMsgLen and MaxMsgLen
+	// apply to the uncompressed message. Both peers must agree on it.
+	Compressor        Compressor
+	CompressThreshold uint32
 }
 
 func DefaultOption() *Option {
@@ -34,6 +48,13 @@ func (opt *Option) Validation() error {
 	default:
 		return fmt.Errorf("parser option invalid LenMsgLen %v", opt.LenMsgLen)
 	}
+	if opt.Compressor != nil {
+		if opt.Compressor.ID() == CompressNone {
+			return fmt.Errorf("parser option invalid compressor id %v", opt.Compressor.ID())
+		}
+		// room for the flag byte
+		max--
+	}
 	if opt.MinMsgLen > max {
 		opt.MinMsgLen = max
 	}
@@ -43,9 +64,10 @@ func (opt *Option) Validation() error {
 	return nil
 }
 
-func (opt *Option) readMsgLen(reader io.Reader) (msgLen uint32, err error) {
-	var b [4]byte
-	bufMsgLen := b[:opt.LenMsgLen]
+// readMsgLen reads the length prefix using scratch, which needs room for
+// LenMsgLen bytes.
+func (opt *Option) readMsgLen(reader io.Reader, scratch []byte) (msgLen uint32, err error) {
+	bufMsgLen := scratch[:opt.LenMsgLen]
 
 	// read len
 	if _, err = io.ReadFull(reader, bufMsgLen); err != nil {
@@ -70,12 +92,53 @@ func (opt *Option) readMsgLen(reader io.Reader) (msgLen uint32, err error) {
 		}
 	}
 
-	// check len
-	if msgLen > opt.MaxMsgLen {
-		return 0, fmt.Errorf("message too long, exceeded specified limit %d", opt.MaxMsgLen)
-	} else if msgLen < opt.MinMsgLen {
-		return 0, fmt.Errorf("message too short， exceeded specified limit %d", opt.MinMsgLen)
+	if msgLen == 0 && opt.Heartbeat {
+		return 0, nil
+	}
+
+	if opt.Compressor != nil {
+		// the body is checked once decompressed
+		if msgLen == 0 {
+			return 0, fmt.Errorf("%w, missing compression flag", ErrMsgTooShort)
+		} else if msgLen-1 > opt.MaxMsgLen {
+			return 0, fmt.Errorf("%w, exceeded specified limit %d", ErrMsgTooLong, opt.MaxMsgLen)
+		}
+		return msgLen, nil
+	}
+
+	if err = opt.CheckMsgLen(msgLen); err != nil {
+		return 0, err
 	}
 
 	return msgLen, nil
 }
+
+func (opt *Option) putMsgLen(b []byte, msgLen uint32) {
+	switch opt.LenMsgLen {
+	case 1:
+		b[0] = byte(msgLen)
+	case 2:
+		if opt.LittleEndian {
+			binary.LittleEndian.PutUint16(b, uint16(msgLen))
+		} else {
+			binary.BigEndian.PutUint16(b, uint16(msgLen))
+		}
+	case 4:
+		if opt.LittleEndian {
+			binary.LittleEndian.PutUint32(b, msgLen)
+		} else {
+			binary.BigEndian.PutUint32(b, msgLen)
+		}
+	}
+}
+
+// CheckMsgLen reports whether a message body of msgLen bytes fits the
+// MinMsgLen/MaxMsgLen limits.
+func (opt *Option) CheckMsgLen(msgLen uint32) error {
+	if msgLen > opt.MaxMsgLen {
+		return fmt.Errorf("%w, exceeded specified limit %d", ErrMsgTooLong, opt.MaxMsgLen)
+	} else if msgLen < opt.MinMsgLen {
+		return fmt.Errorf("%w, exceeded specified limit %d", ErrMsgTooShort, opt.MinMsgLen)
+	}
+	return nil
+}
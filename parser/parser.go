@@ -7,7 +7,6 @@
 package parser
 
 import (
-	"encoding/binary"
 	"fmt"
 	"io"
 )
@@ -27,20 +26,60 @@ func NewMsgParser(opt *Option) (*Parser, error) {
 }
 
 func (p *Parser) Read(reader io.Reader) ([]byte, error) {
-	msgLen, err := p.opts.readMsgLen(reader)
+	return p.ReadInto(reader, nil)
+}
+
+// ReadInto reads the next message like Read, but into buf when its
+// capacity is large enough. The returned message then aliases buf and is
+// only valid until buf is reused. Compressed messages are always allocated.
+func (p *Parser) ReadInto(reader io.Reader, buf []byte) ([]byte, error) {
+	scratch := buf
+	if cap(scratch) < p.opts.LenMsgLen {
+		scratch = make([]byte, p.opts.LenMsgLen)
+	}
+	msgLen, err := p.opts.readMsgLen(reader, scratch[:cap(scratch)])
 	if err != nil {
 		return nil, err
 	}
 
 	// data
-	buffer := make([]byte, msgLen)
+	var buffer []byte
+	if uint32(cap(buf)) >= msgLen {
+		buffer = buf[:msgLen]
+	} else {
+		buffer = make([]byte, msgLen)
+	}
 	if _, err = io.ReadFull(reader, buffer); err != nil {
 		return nil, err
 	}
 
+	if p.opts.Compressor != nil && msgLen > 0 {
+		return p.decompress(buffer)
+	}
+
 	return buffer, nil
 }
 
+func (p *Parser) decompress(buffer []byte) ([]byte, error) {
+	flag, body := buffer[0], buffer[1:]
+
+	switch flag {
+	case CompressNone:
+	case p.opts.Compressor.ID():
+		var err error
+		if body, err = p.opts.Compressor.Decompress(body, p.opts.MaxMsgLen); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown compression flag %d", flag)
+	}
+
+	if err := p.opts.CheckMsgLen(uint32(len(body))); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
 func (p *Parser) PackMsg(args ...[]byte) ([]byte, error) {
 	// get len
 	var msgLen uint32
@@ -49,34 +88,99 @@ func (p *Parser) PackMsg(args ...[]byte) ([]byte, error) {
 	}
 
 	// check len
-	if msgLen > p.opts.MaxMsgLen {
-		return nil, fmt.Errorf("message too long, exceeded specified limit %d", p.opts.MaxMsgLen)
-	} else if msgLen < p.opts.MinMsgLen {
-		return nil, fmt.Errorf("message too short, exceeded specified limit %d", p.opts.MinMsgLen)
+	if err := p.opts.CheckMsgLen(msgLen); err != nil {
+		return nil, err
+	}
+	if msgLen == 0 && p.opts.Heartbeat {
+		return nil, fmt.Errorf("%w, zero-length frames are reserved for heartbeats", ErrMsgTooShort)
+	}
+
+	if p.opts.Compressor != nil {
+		return p.packCompressed(msgLen, args)
 	}
 
 	msg := make([]byte, uint32(p.opts.LenMsgLen)+msgLen)
 
 	// write len
-	switch p.opts.LenMsgLen {
-	case 1:
-		msg[0] = byte(msgLen)
-	case 2:
-		if p.opts.LittleEndian {
-			binary.LittleEndian.PutUint16(msg, uint16(msgLen))
-		} else {
-			binary.BigEndian.PutUint16(msg, uint16(msgLen))
+	p.opts.putMsgLen(msg, msgLen)
+
+	// write data
+	l := p.opts.LenMsgLen
+	for i := 0; i < len(args); i++ {
+		copy(msg[l:], args[i])
+		l += len(args[i])
+	}
+
+	return msg, nil
+}
+
+// PackParts is PackMsg without the copy: it returns the length header
+// followed by args, to be written in order, e.g. with net.Buffers. With a
+// compressor the frame is packed by PackMsg and returned as one part.
+func (p *Parser) PackParts(args ...[]byte) ([][]byte, error) {
+	if p.opts.Compressor != nil {
+		msg, err := p.PackMsg(args...)
+		if err != nil {
+			return nil, err
 		}
-	case 4:
-		if p.opts.LittleEndian {
-			binary.LittleEndian.PutUint32(msg, msgLen)
-		} else {
-			binary.BigEndian.PutUint32(msg, msgLen)
+		return [][]byte{msg}, nil
+	}
+
+	// get len
+	var msgLen uint32
+	for i := 0; i < len(args); i++ {
+		msgLen += uint32(len(args[i]))
+	}
+
+	// check len
+	if err := p.opts.CheckMsgLen(msgLen); err != nil {
+		return nil, err
+	}
+	if msgLen == 0 && p.opts.Heartbeat {
+		return nil, fmt.Errorf("%w, zero-length frames are reserved for heartbeats", ErrMsgTooShort)
+	}
+
+	parts := make([][]byte, 0, len(args)+1)
+	header := make([]byte, p.opts.LenMsgLen)
+	p.opts.putMsgLen(header, msgLen)
+	parts = append(parts, header)
+	for i := 0; i < len(args); i++ {
+		if len(args[i]) > 0 {
+			parts = append(parts, args[i])
+		}
+	}
+	return parts, nil
+}
+
+// packCompressed writes the flag byte after the length and compresses the
+// body when it reaches the threshold and compression pays off.
+func (p *Parser) packCompressed(msgLen uint32, args [][]byte) ([]byte, error) {
+	flag := CompressNone
+	if msgLen > 0 && msgLen >= p.opts.CompressThreshold {
+		data := args[0]
+		if len(args) > 1 {
+			data = make([]byte, 0, msgLen)
+			for i := 0; i < len(args); i++ {
+				data = append(data, args[i]...)
+			}
+		}
+
+		compressed, err := p.opts.Compressor.Compress(data)
+		if err != nil {
+			return nil, err
+		}
+		if uint32(len(compressed)) < msgLen {
+			flag = p.opts.Compressor.ID()
+			args = [][]byte{compressed}
+			msgLen = uint32(len(compressed))
 		}
 	}
 
-	// write data
 	l := p.opts.LenMsgLen
+	msg := make([]byte, uint32(l)+1+msgLen)
+	p.opts.putMsgLen(msg, msgLen+1)
+	msg[l] = flag
+	l++
 	for i := 0; i < len(args); i++ {
 		copy(msg[l:], args[i])
 		l += len(args[i])
@@ -84,3 +188,13 @@ func (p *Parser) PackMsg(args ...[]byte) ([]byte, error) {
 
 	return msg, nil
 }
+
+// Heartbeat reports whether zero-length frames are heartbeats.
+func (p *Parser) Heartbeat() bool {
+	return p.opts.Heartbeat
+}
+
+// PackHeartbeat returns a zero-length frame.
+func (p *Parser) PackHeartbeat() []byte {
+	return make([]byte, p.opts.LenMsgLen)
+}
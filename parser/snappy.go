@@ -0,0 +1,31 @@
+package parser
+
+import (
+	"fmt"
+
+	"github.com/klauspost/compress/snappy"
+)
+
+// Snappy is a Compressor using the snappy block format, fast with a lower
+// ratio than Flate.
+type Snappy struct{}
+
+func (Snappy) ID() byte {
+	return CompressSnappy
+}
+
+func (Snappy) Compress(src []byte) ([]byte, error) {
+	return snappy.Encode(nil, src), nil
+}
+
+func (Snappy) Decompress(src []byte, maxLen uint32) ([]byte, error) {
+	// the block header tells the decompressed size before any work
+	n, err := snappy.DecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	if uint32(n) > maxLen {
+		return nil, fmt.Errorf("%w, decompressed size exceeded specified limit %d", ErrMsgTooLong, maxLen)
+	}
+	return snappy.Decode(nil, src)
+}
@@ -0,0 +1,69 @@
+package parser
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdMaxWindow is the largest window accepted from a peer, the one the
+// encoder uses by default.
+const zstdMaxWindow = 8 << 20
+
+// Zstd is a Compressor backed by the zstd package of klauspost/compress.
+type Zstd struct {
+	// Level is a zstd level, e.g. 3, 0 selects zstd.SpeedDefault.
+	Level int
+
+	once    sync.Once
+	encoder *zstd.Encoder
+	err     error
+	readers sync.Pool
+}
+
+func (c *Zstd) ID() byte {
+	return CompressZstd
+}
+
+func (c *Zstd) Compress(src []byte) ([]byte, error) {
+	c.once.Do(func() {
+		level := zstd.SpeedDefault
+		if c.Level != 0 {
+			level = zstd.EncoderLevelFromZstd(c.Level)
+		}
+		c.encoder, c.err = zstd.NewWriter(nil, zstd.WithEncoderLevel(level))
+	})
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.encoder.EncodeAll(src, nil), nil
+}
+
+func (c *Zstd) Decompress(src []byte, maxLen uint32) ([]byte, error) {
+	r, _ := c.readers.Get().(*zstd.Decoder)
+	if r == nil {
+		// synchronous decoders leave nothing running in the pool, the
+		// window cap bounds the memory a hostile frame can claim
+		var err error
+		r, err = zstd.NewReader(bytes.NewReader(src), zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(zstdMaxWindow))
+		if err != nil {
+			return nil, err
+		}
+	} else if err := r.Reset(bytes.NewReader(src)); err != nil {
+		return nil, err
+	}
+	defer c.readers.Put(r)
+
+	// read one byte past the limit to detect oversized output
+	out, err := io.ReadAll(io.LimitReader(r, int64(maxLen)+1))
+	if err != nil {
+		return nil, err
+	}
+	if uint32(len(out)) > maxLen {
+		return nil, fmt.Errorf("%w, decompressed size exceeded specified limit %d", ErrMsgTooLong, maxLen)
+	}
+	return out, nil
+}
@@ -0,0 +1,326 @@
+package netlib
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gzjjyz/netlib/metrics"
+)
+
+var ErrRateLimited = errors.New("rate limited")
+
+// LimitKind names the limit a peer exceeded.
+type LimitKind int
+
+const (
+	// LimitMsgRate is RateLimitOptions.MsgsPerSec.
+	LimitMsgRate LimitKind = iota
+	// LimitByteRate is RateLimitOptions.BytesPerSec.
+	LimitByteRate
+	// LimitConnRate is RateLimitOptions.ConnsPerSecPerIP.
+	LimitConnRate
+	// LimitConnsPerIP is RateLimitOptions.MaxConnsPerIP.
+	LimitConnsPerIP
+)
+
+func (k LimitKind) String() string {
+	switch k {
+	case LimitMsgRate:
+		return "msg_rate"
+	case LimitByteRate:
+		return "byte_rate"
+	case LimitConnRate:
+		return "conn_rate"
+	case LimitConnsPerIP:
+		return "conns_per_ip"
+	}
+	return "unknown"
+}
+
+// LimitAction is what happens to a message or connection over a limit.
+type LimitAction int
+
+const (
+	// LimitDisconnect closes the connection, or refuses a new one.
+	LimitDisconnect LimitAction = iota
+	// LimitDrop discards the message, or refuses a new connection.
+	LimitDrop
+	// LimitDelay waits until the limit allows it. LimitConnsPerIP cannot
+	// be waited for and refuses the connection.
+	LimitDelay
+)
+
+// RateLimitOptions configures token bucket limits. Zero values disable each
+// limit, bursts default to one second worth of the rate.
+type RateLimitOptions struct {
+	MsgsPerSec  float64
+	MsgBurst    int
+	BytesPerSec float64
+	BytesBurst  int
+
+	ConnsPerSecPerIP float64
+	ConnBurstPerIP   int
+	MaxConnsPerIP    int
+
+	// OnLimit picks the action for a violation, LimitDisconnect when nil.
+	OnLimit func(remoteAddr net.Addr, kind LimitKind) LimitAction
+}
+
+func (opt *RateLimitOptions) action(remoteAddr net.Addr, kind LimitKind) LimitAction {
+	if opt.OnLimit == nil {
+		return LimitDisconnect
+	}
+	return opt.OnLimit(remoteAddr, kind)
+}
+
+// tokenBucket is not safe for concurrent use, owners serialize access.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	b := float64(burst)
+	if b <= 0 {
+		b = rate
+		if b < 1 {
+			b = 1
+		}
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  b,
+		tokens: b,
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// need caps n at the burst so that oversized requests pass on a full bucket.
+func (b *tokenBucket) need(n float64) float64 {
+	if n > b.burst {
+		return b.burst
+	}
+	return n
+}
+
+func (b *tokenBucket) ready(n float64, now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.need(n)
+}
+
+func (b *tokenBucket) wait(n float64, now time.Time) time.Duration {
+	b.refill(now)
+	missing := b.need(n) - b.tokens
+	if missing <= 0 {
+		return 0
+	}
+	return time.Duration(missing / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) take(n float64) {
+	b.tokens -= n
+}
+
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// connLimiter enforces the message limits of one connection. It is used
+// from ReadMsg only, which is not goroutine safe either.
+type connLimiter struct {
+	opts    *RateLimitOptions
+	msgs    *tokenBucket
+	bytes   *tokenBucket
+	metrics metrics.Metrics
+}
+
+func newConnLimiter(opts *RateLimitOptions, m metrics.Metrics) *connLimiter {
+	msgs := newTokenBucket(opts.MsgsPerSec, opts.MsgBurst)
+	bytes := newTokenBucket(opts.BytesPerSec, opts.BytesBurst)
+	if msgs == nil && bytes == nil {
+		return nil
+	}
+	return &connLimiter{
+		opts:    opts,
+		msgs:    msgs,
+		bytes:   bytes,
+		metrics: m,
+	}
+}
+
+// check accounts for one inbound message of n bytes. It reports whether the
+// message must be dropped, or returns ErrRateLimited to disconnect.
+func (l *connLimiter) check(remoteAddr net.Addr, n int) (bool, error) {
+	now := time.Now()
+	kind := LimitKind(-1)
+	if l.msgs != nil && !l.msgs.ready(1, now) {
+		kind = LimitMsgRate
+	} else if l.bytes != nil && !l.bytes.ready(float64(n), now) {
+		kind = LimitByteRate
+	}
+
+	if kind >= 0 {
+		l.metrics.RateLimited(kind.String())
+
+		switch l.opts.action(remoteAddr, kind) {
+		case LimitDrop:
+			return true, nil
+		case LimitDelay:
+			var wait time.Duration
+			if l.msgs != nil {
+				wait = l.msgs.wait(1, now)
+			}
+			if l.bytes != nil {
+				if w := l.bytes.wait(float64(n), now); w > wait {
+					wait = w
+				}
+			}
+			time.Sleep(wait)
+		default:
+			return false, ErrRateLimited
+		}
+	}
+
+	if l.msgs != nil {
+		l.msgs.take(1)
+	}
+	if l.bytes != nil {
+		l.bytes.take(float64(n))
+	}
+	return false, nil
+}
+
+const ipLimiterSweepInterval = time.Minute
+
+type ipEntry struct {
+	bucket *tokenBucket
+	conns  int
+}
+
+// ipLimiter enforces the per source IP connection limits of a server.
+type ipLimiter struct {
+	opts      *RateLimitOptions
+	metrics   metrics.Metrics
+	mu        sync.Mutex
+	entries   map[string]*ipEntry
+	lastSweep time.Time
+}
+
+func newIPLimiter(opts *RateLimitOptions, m metrics.Metrics) *ipLimiter {
+	if opts.ConnsPerSecPerIP <= 0 && opts.MaxConnsPerIP <= 0 {
+		return nil
+	}
+	return &ipLimiter{
+		opts:      opts,
+		metrics:   m,
+		entries:   make(map[string]*ipEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+// ipKey groups addresses by IP, other kinds of addresses by their string.
+func ipKey(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
+
+// parseRemoteAddr turns http.Request.RemoteAddr into a net.Addr.
+func parseRemoteAddr(s string) net.Addr {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return &net.TCPAddr{IP: net.ParseIP(s)}
+	}
+	p, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+}
+
+// acquire admits a new connection from addr, waiting when the policy asks
+// for it. Every successful acquire must be paired with a release.
+func (l *ipLimiter) acquire(addr net.Addr) error {
+	key := ipKey(addr)
+
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		l.sweep(now)
+
+		e, ok := l.entries[key]
+		if !ok {
+			e = &ipEntry{bucket: newTokenBucket(l.opts.ConnsPerSecPerIP, l.opts.ConnBurstPerIP)}
+			l.entries[key] = e
+		}
+
+		kind := LimitKind(-1)
+		var wait time.Duration
+		if l.opts.MaxConnsPerIP > 0 && e.conns >= l.opts.MaxConnsPerIP {
+			kind = LimitConnsPerIP
+		} else if e.bucket != nil && !e.bucket.ready(1, now) {
+			kind = LimitConnRate
+			wait = e.bucket.wait(1, now)
+		}
+
+		if kind < 0 {
+			if e.bucket != nil {
+				e.bucket.take(1)
+			}
+			e.conns++
+			l.mu.Unlock()
+			return nil
+		}
+		l.mu.Unlock()
+
+		l.metrics.RateLimited(kind.String())
+		if l.opts.action(addr, kind) == LimitDelay && kind == LimitConnRate {
+			time.Sleep(wait)
+			continue
+		}
+		return ErrRateLimited
+	}
+}
+
+func (l *ipLimiter) release(addr net.Addr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.entries[ipKey(addr)]; ok && e.conns > 0 {
+		e.conns--
+	}
+}
+
+// sweep forgets idle addresses, l.mu must be held.
+func (l *ipLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < ipLimiterSweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for key, e := range l.entries {
+		if e.conns == 0 && (e.bucket == nil || e.bucket.full(now)) {
+			delete(l.entries, key)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package netlib
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	// defaultMaxBackoff caps a growing delay when BackoffOptions.Max is zero
+	defaultMaxBackoff = time.Minute
+	// defaultStableAfter is BackoffOptions.StableAfter when zero
+	defaultStableAfter = 10 * time.Second
+)
+
+// BackoffOptions spaces the connection attempts of a client. The zero value
+// retries every ConnectInterval forever.
+type BackoffOptions struct {
+	// Initial is the delay after the first failure, ConnectInterval when zero.
+	Initial time.Duration
+	// Max caps the delay. When zero a delay grown by Multiplier is capped
+	// at one minute and a fixed one is left as it is.
+	Max time.Duration
+	// Multiplier grows the delay after each failed attempt, e.g. 2. Values
+	// up to 1 keep it fixed.
+	Multiplier float64
+	// Jitter spreads each delay randomly by up to this fraction of it, e.g.
+	// 0.2 for ±20%, so that clients of a restarted server do not reconnect
+	// all at once.
+	Jitter float64
+	// MaxAttempts gives up after this many failed attempts in a row, zero
+	// retries forever. A connection lost before StableAfter counts as a
+	// failed attempt.
+	MaxAttempts int
+	// StableAfter is how long a connection must stay up to reset the
+	// failed attempts, 10 seconds when zero.
+	StableAfter time.Duration
+}
+
+// delay returns the wait after the failed attempt numbered from 0.
+func (b *BackoffOptions) delay(attempt int, interval time.Duration) time.Duration {
+	d := b.Initial
+	if d <= 0 {
+		d = interval
+	}
+	max := b.Max
+
+	f := float64(d)
+	if b.Multiplier > 1 {
+		f *= math.Pow(b.Multiplier, float64(attempt))
+		if max <= 0 {
+			max = defaultMaxBackoff
+		}
+	}
+	if max > 0 && f > float64(max) {
+		f = float64(max)
+	}
+	if b.Jitter > 0 {
+		f *= 1 + b.Jitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(f)
+}
+
+// stable reports whether a connection that lasted d resets the failures.
+func (b *BackoffOptions) stable(d time.Duration) bool {
+	stableAfter := b.StableAfter
+	if stableAfter <= 0 {
+		stableAfter = defaultStableAfter
+	}
+	return d >= stableAfter
+}
+
+// exhausted reports whether no attempt is left after failures in a row.
+func (b *BackoffOptions) exhausted(failures int) bool {
+	return b.MaxAttempts > 0 && failures >= b.MaxAttempts
+}
+
+// ClientState is the connection state of a TCPClient or WSClient.
+type ClientState int32
+
+const (
+	// StateIdle is the state before Start.
+	StateIdle ClientState = iota
+	// StateConnecting is reported before each attempt.
+	StateConnecting
+	// StateConnected is reported once the agent is created.
+	StateConnected
+	// StateDisconnected is reported with the reason when the connection
+	// ends or an attempt fails, before waiting for the next one.
+	StateDisconnected
+	// StateGaveUp is reported with the last error when no attempt is left.
+	StateGaveUp
+	// StateStopped is the state after Stop.
+	StateStopped
+)
+
+func (s ClientState) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateGaveUp:
+		return "gave-up"
+	case StateStopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+// sleep waits for d and reports false when stop is closed first.
+func sleep(d time.Duration, stop <-chan struct{}) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
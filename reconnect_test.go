@@ -0,0 +1,136 @@
+package netlib
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		b        BackoffOptions
+		attempt  int
+		interval time.Duration
+		want     time.Duration
+	}{
+		{"fixed interval", BackoffOptions{}, 5, time.Second, time.Second},
+		{"fixed interval over the default cap", BackoffOptions{}, 5, 2 * time.Minute, 2 * time.Minute},
+		{"initial", BackoffOptions{Initial: 100 * time.Millisecond}, 3, time.Second, 100 * time.Millisecond},
+		{"first attempt", BackoffOptions{Multiplier: 2}, 0, time.Second, time.Second},
+		{"grown", BackoffOptions{Multiplier: 2}, 3, time.Second, 8 * time.Second},
+		{"grown from initial", BackoffOptions{Initial: 100 * time.Millisecond, Multiplier: 3}, 2, time.Second, 900 * time.Millisecond},
+		{"capped at Max", BackoffOptions{Multiplier: 2, Max: 5 * time.Second}, 3, time.Second, 5 * time.Second},
+		{"default cap", BackoffOptions{Multiplier: 2}, 10, time.Second, time.Minute},
+		{"huge attempt", BackoffOptions{Multiplier: 2}, 5000, time.Second, time.Minute},
+		{"fixed under Max", BackoffOptions{Max: time.Second}, 3, 2 * time.Second, time.Second},
+		{"multiplier of 1", BackoffOptions{Multiplier: 1}, 10, time.Second, time.Second},
+	} {
+		if got := tc.b.delay(tc.attempt, tc.interval); got != tc.want {
+			t.Errorf("%s: delay %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	b := BackoffOptions{Multiplier: 2, Jitter: 0.2}
+	var low, high bool
+	for i := 0; i < 1000; i++ {
+		d := b.delay(2, time.Second)
+		if d < 3200*time.Millisecond || d > 4800*time.Millisecond {
+			t.Fatalf("delay %v out of 4s ±20%%", d)
+		}
+		low = low || d < 4*time.Second
+		high = high || d > 4*time.Second
+	}
+	if !low || !high {
+		t.Error("jitter does not spread both ways")
+	}
+}
+
+func TestBackoffAttempts(t *testing.T) {
+	b := BackoffOptions{MaxAttempts: 3}
+	for failures, want := range []bool{false, false, false, true, true} {
+		if got := b.exhausted(failures); got != want {
+			t.Errorf("exhausted after %d failures: %v, want %v", failures, got, want)
+		}
+	}
+	if (&BackoffOptions{}).exhausted(1000) {
+		t.Error("zero MaxAttempts gave up")
+	}
+}
+
+func TestBackoffStable(t *testing.T) {
+	for _, tc := range []struct {
+		b    BackoffOptions
+		d    time.Duration
+		want bool
+	}{
+		{BackoffOptions{}, 9 * time.Second, false},
+		{BackoffOptions{}, 10 * time.Second, true},
+		{BackoffOptions{StableAfter: time.Second}, 500 * time.Millisecond, false},
+		{BackoffOptions{StableAfter: time.Second}, time.Second, true},
+	} {
+		if got := tc.b.stable(tc.d); got != tc.want {
+			t.Errorf("stable(%v) with StableAfter %v: %v, want %v", tc.d, tc.b.StableAfter, got, tc.want)
+		}
+	}
+}
+
+// A server dropping every connection right away must not keep a client
+// with MaxAttempts retrying forever.
+func TestShortLivedConnectionsGiveUp(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	gaveUp := make(chan struct{})
+	client, err := NewTCPClient(ln.Addr().String(), 10, 10*time.Millisecond, func(conn *TCPConn) Agent {
+		return &readAgent{conn}
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Backoff = BackoffOptions{MaxAttempts: 3}
+	client.OnStateChange = func(state ClientState, err error) {
+		if state == StateGaveUp {
+			close(gaveUp)
+		}
+	}
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+
+	select {
+	case <-gaveUp:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("client still %v", client.State())
+	}
+}
+
+// readAgent reads until the connection ends.
+type readAgent struct {
+	conn *TCPConn
+}
+
+func (a *readAgent) Run() {
+	for {
+		if _, err := a.conn.ReadMsg(); err != nil {
+			return
+		}
+	}
+}
+
+func (a *readAgent) OnClose() {}
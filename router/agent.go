@@ -0,0 +1,44 @@
+package router
+
+import (
+	"github.com/gzjjyz/netlib"
+	"github.com/gzjjyz/netlib/log"
+)
+
+type agent struct {
+	conn   netlib.Conn
+	router *Router
+}
+
+// NewAgent returns an agent that dispatches every message read from conn
+// through the router. It fits the NewAgent hook of both TCPServer and
+// WSServer:
+//
+//	func(conn *netlib.TCPConn) netlib.Agent { return r.NewAgent(conn) }
+func (r *Router) NewAgent(conn netlib.Conn) netlib.Agent {
+	return &agent{
+		conn:   conn,
+		router: r,
+	}
+}
+
+func (a *agent) Run() {
+	for {
+		msg, err := a.conn.ReadMsg()
+		if err != nil {
+			log.Debug("read message: %v", err)
+			break
+		}
+
+		if err = a.router.Dispatch(a.conn, msg); err != nil {
+			log.Debug("dispatch message: %v", err)
+			break
+		}
+	}
+}
+
+func (a *agent) OnClose() {
+	if a.router.OnClose != nil {
+		a.router.OnClose(a.conn)
+	}
+}
@@ -0,0 +1,54 @@
+package router
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Option describes the message header that follows the length prefix
+// written by parser.Parser.PackMsg.
+type Option struct {
+	LenMsgID     int
+	LittleEndian bool
+}
+
+func DefaultOption() *Option {
+	return &Option{
+		LenMsgID: 2,
+	}
+}
+
+func (opt *Option) Validation() error {
+	switch opt.LenMsgID {
+	case 2, 4:
+	default:
+		return fmt.Errorf("router option invalid LenMsgID %v", opt.LenMsgID)
+	}
+	return nil
+}
+
+func (opt *Option) byteOrder() binary.ByteOrder {
+	if opt.LittleEndian {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+func (opt *Option) putMsgID(b []byte, id uint32) {
+	switch opt.LenMsgID {
+	case 2:
+		opt.byteOrder().PutUint16(b, uint16(id))
+	case 4:
+		opt.byteOrder().PutUint32(b, id)
+	}
+}
+
+func (opt *Option) msgID(b []byte) uint32 {
+	switch opt.LenMsgID {
+	case 2:
+		return uint32(opt.byteOrder().Uint16(b))
+	case 4:
+		return opt.byteOrder().Uint32(b)
+	}
+	return 0
+}
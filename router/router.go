@@ -0,0 +1,113 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/gzjjyz/netlib"
+)
+
+// Handler handles the payload of one inbound message, the message ID
+// header already stripped.
+type Handler func(conn netlib.Conn, payload []byte)
+
+type Router struct {
+	opts     *Option
+	handlers map[uint32]Handler
+	mu       sync.RWMutex
+
+	// OnUnknown is called for messages whose ID has no registered handler.
+	OnUnknown func(conn netlib.Conn, id uint32, payload []byte)
+	// OnClose is called once the agent of conn stops running.
+	OnClose func(conn netlib.Conn)
+}
+
+func NewRouter(opts *Option) (*Router, error) {
+	if opts == nil {
+		opts = DefaultOption()
+	}
+	if err := opts.Validation(); err != nil {
+		return nil, err
+	}
+
+	return &Router{
+		opts:     opts,
+		handlers: make(map[uint32]Handler),
+	}, nil
+}
+
+func (r *Router) Register(id uint32, handler Handler) error {
+	if handler == nil {
+		return errors.New("handler must not be nil")
+	}
+	if err := r.checkID(id); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.handlers[id]; ok {
+		return fmt.Errorf("message id %d already registered", id)
+	}
+	r.handlers[id] = handler
+	return nil
+}
+
+func (r *Router) checkID(id uint32) error {
+	if r.opts.LenMsgID == 2 && id > math.MaxUint16 {
+		return fmt.Errorf("message id %d overflows LenMsgID %d", id, r.opts.LenMsgID)
+	}
+	return nil
+}
+
+func (r *Router) Unregister(id uint32) {
+	r.mu.Lock()
+	delete(r.handlers, id)
+	r.mu.Unlock()
+}
+
+// Unpack splits an inbound message into its ID and payload.
+func (r *Router) Unpack(msg []byte) (uint32, []byte, error) {
+	if len(msg) < r.opts.LenMsgID {
+		return 0, nil, fmt.Errorf("message too short, missing %d bytes message id", r.opts.LenMsgID)
+	}
+	return r.opts.msgID(msg), msg[r.opts.LenMsgID:], nil
+}
+
+// Write sends the payload prefixed with id through conn.
+func (r *Router) Write(conn netlib.Conn, id uint32, payload ...[]byte) error {
+	if err := r.checkID(id); err != nil {
+		return err
+	}
+	header := make([]byte, r.opts.LenMsgID)
+	r.opts.putMsgID(header, id)
+
+	args := make([][]byte, 0, len(payload)+1)
+	args = append(args, header)
+	args = append(args, payload...)
+	return conn.WriteMsg(args...)
+}
+
+// Dispatch routes an inbound message to the handler registered for its ID.
+func (r *Router) Dispatch(conn netlib.Conn, msg []byte) error {
+	id, payload, err := r.Unpack(msg)
+	if err != nil {
+		return err
+	}
+
+	r.mu.RLock()
+	handler, ok := r.handlers[id]
+	r.mu.RUnlock()
+
+	if !ok {
+		if r.OnUnknown != nil {
+			r.OnUnknown(conn, id, payload)
+		}
+		return nil
+	}
+
+	handler(conn, payload)
+	return nil
+}
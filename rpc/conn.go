@@ -0,0 +1,252 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/gzjjyz/netlib"
+	"github.com/gzjjyz/netlib/log"
+)
+
+// ErrClosed fails the calls pending when the connection closes, wrapping
+// the read error that ended it.
+var ErrClosed = errors.New("rpc connection closed")
+
+// RemoteError is returned by Call when the handler of the peer failed or
+// the method is unknown to it.
+type RemoteError struct {
+	Method  string
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("rpc %s: %s", e.Method, e.Message)
+}
+
+// notifyQueueLen is how many notifications wait for their handlers before
+// reading stops.
+const notifyQueueLen = 64
+
+type result struct {
+	payload []byte
+	err     error
+}
+
+// Conn runs requests, responses and notifications over a netlib.Conn.
+// Both ends may call and serve. It is the agent of the connection: Run
+// reads and dispatches frames until the connection closes.
+type Conn struct {
+	conn     netlib.Conn
+	registry *Registry
+	ctx      context.Context
+	cancel   context.CancelFunc
+	// slots bounds the requests served at once
+	slots chan struct{}
+	// notifies feeds the notification handlers in order
+	notifies chan frame
+
+	mu      sync.Mutex
+	seq     uint32
+	pending map[uint32]*call
+	err     error
+}
+
+type call struct {
+	method string
+	done   chan result
+}
+
+// NewConn wraps conn. registry serves the requests of the peer, nil
+// rejects them all.
+func NewConn(conn netlib.Conn, registry *Registry) *Conn {
+	if registry == nil {
+		registry = NewRegistry()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Conn{
+		conn:     conn,
+		registry: registry,
+		ctx:      ctx,
+		cancel:   cancel,
+		slots:    make(chan struct{}, registry.maxConcurrent()),
+		notifies: make(chan frame, notifyQueueLen),
+		pending:  make(map[uint32]*call),
+	}
+}
+
+// Conn returns the underlying connection.
+func (c *Conn) Conn() netlib.Conn {
+	return c.conn
+}
+
+// Call sends a request and waits for its response until ctx is done. req
+// is queued without a copy and must not be modified afterwards.
+func (c *Conn) Call(ctx context.Context, method string, req []byte) ([]byte, error) {
+	cl := &call{method: method, done: make(chan result, 1)}
+
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return nil, err
+	}
+	c.seq++
+	if c.seq == 0 {
+		// 0 is the seq of notifications
+		c.seq++
+	}
+	seq := c.seq
+	c.pending[seq] = cl
+	c.mu.Unlock()
+
+	header, err := packHeader(kindRequest, seq, method)
+	if err == nil {
+		err = c.conn.WriteMsg(header, req)
+	}
+	if err != nil {
+		c.forget(seq)
+		return nil, err
+	}
+
+	select {
+	case r := <-cl.done:
+		return r.payload, r.err
+	case <-ctx.Done():
+		c.forget(seq)
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Conn) forget(seq uint32) {
+	c.mu.Lock()
+	delete(c.pending, seq)
+	c.mu.Unlock()
+}
+
+// Notify sends a one-way message, no response is expected.
+func (c *Conn) Notify(method string, payload []byte) error {
+	header, err := packHeader(kindNotify, 0, method)
+	if err != nil {
+		return err
+	}
+	return c.conn.WriteMsg(header, payload)
+}
+
+// Run reads and dispatches frames. Requests are served concurrently,
+// notifications one at a time in the order they arrived, off the reading
+// goroutine. It returns once the queued notifications are handled.
+func (c *Conn) Run() {
+	notified := make(chan struct{})
+	go c.runNotifies(notified)
+
+	var err error
+	for {
+		var msg []byte
+		msg, err = c.conn.ReadMsg()
+		if err != nil {
+			break
+		}
+
+		if err = c.dispatch(msg); err != nil {
+			log.Debug("rpc dispatch: %v", err)
+			break
+		}
+	}
+	close(c.notifies)
+	c.fail(err)
+	<-notified
+}
+
+func (c *Conn) runNotifies(done chan struct{}) {
+	defer close(done)
+	for f := range c.notifies {
+		if h, ok := c.registry.notifyHandler(f.method); ok {
+			h(c, f.payload)
+		} else {
+			log.Debug("rpc notification %q has no handler", f.method)
+		}
+	}
+}
+
+func (c *Conn) OnClose() {
+	// Run may not have been called
+	c.fail(netlib.ErrConnClosed)
+	if c.registry.OnClose != nil {
+		c.registry.OnClose(c)
+	}
+}
+
+// fail ends the pending calls and every later one with ErrClosed.
+func (c *Conn) fail(cause error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return
+	}
+	c.err = fmt.Errorf("%w: %v", ErrClosed, cause)
+	pending := c.pending
+	c.pending = make(map[uint32]*call)
+	err := c.err
+	c.mu.Unlock()
+
+	c.cancel()
+	c.conn.Close()
+	for _, cl := range pending {
+		cl.done <- result{err: err}
+	}
+}
+
+func (c *Conn) dispatch(msg []byte) error {
+	f, err := unpackFrame(msg)
+	if err != nil {
+		return err
+	}
+
+	switch f.kind {
+	case kindRequest:
+		c.slots <- struct{}{}
+		go c.serve(f)
+	case kindNotify:
+		c.notifies <- f
+	case kindResponse, kindError:
+		c.mu.Lock()
+		cl, ok := c.pending[f.seq]
+		delete(c.pending, f.seq)
+		c.mu.Unlock()
+		if !ok {
+			// the call timed out or was cancelled
+			return nil
+		}
+
+		if f.kind == kindError {
+			cl.done <- result{err: &RemoteError{Method: cl.method, Message: string(f.payload)}}
+		} else {
+			cl.done <- result{payload: f.payload}
+		}
+	}
+	return nil
+}
+
+func (c *Conn) serve(f frame) {
+	defer func() { <-c.slots }()
+
+	var resp []byte
+	var err error
+	if h, ok := c.registry.handler(f.method); ok {
+		resp, err = h(c.ctx, c, f.payload)
+	} else {
+		err = fmt.Errorf("unknown method %q", f.method)
+	}
+
+	kind := kindResponse
+	if err != nil {
+		kind = kindError
+		resp = []byte(err.Error())
+	}
+	header, _ := packHeader(kind, f.seq, "")
+	if err = c.conn.WriteMsg(header, resp); err != nil {
+		log.Debug("rpc %s response: %v", f.method, err)
+	}
+}
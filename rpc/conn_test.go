@@ -0,0 +1,270 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gzjjyz/netlib"
+	"github.com/gzjjyz/netlib/log"
+)
+
+type nopLogger struct{}
+
+func (nopLogger) LogDebug(string, ...interface{}) {}
+func (nopLogger) LogInfo(string, ...interface{})  {}
+func (nopLogger) LogWarn(string, ...interface{})  {}
+func (nopLogger) LogError(string, ...interface{}) {}
+func (nopLogger) LogFatal(string, ...interface{}) {}
+
+func TestMain(m *testing.M) {
+	log.SetLogger(nopLogger{})
+	os.Exit(m.Run())
+}
+
+// memConn is one end of an in-memory netlib.Conn pair. Closing either end
+// ends both, like a socket.
+type memConn struct {
+	in     chan []byte
+	peer   *memConn
+	closed chan struct{}
+	once   *sync.Once
+}
+
+func memPipe() (*memConn, *memConn) {
+	closed := make(chan struct{})
+	once := new(sync.Once)
+	a := &memConn{in: make(chan []byte, 64), closed: closed, once: once}
+	b := &memConn{in: make(chan []byte, 64), closed: closed, once: once}
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+func (c *memConn) ReadMsg() ([]byte, error) {
+	select {
+	case msg := <-c.in:
+		return msg, nil
+	case <-c.closed:
+		return nil, netlib.ErrConnClosed
+	}
+}
+
+func (c *memConn) WriteMsg(args ...[]byte) error {
+	var msg []byte
+	for _, arg := range args {
+		msg = append(msg, arg...)
+	}
+	select {
+	case c.peer.in <- msg:
+		return nil
+	case <-c.closed:
+		return netlib.ErrConnClosed
+	}
+}
+
+func (c *memConn) LocalAddr() net.Addr  { return nil }
+func (c *memConn) RemoteAddr() net.Addr { return nil }
+func (c *memConn) Close()               { c.once.Do(func() { close(c.closed) }) }
+func (c *memConn) Destroy()             { c.Close() }
+
+// newPair runs a client and a server rpc connection over memPipe. The
+// server serves reg.
+func newPair(t *testing.T, reg *Registry) (client, server *Conn) {
+	a, b := memPipe()
+	client = NewConn(a, nil)
+	server = NewConn(b, reg)
+
+	var wg sync.WaitGroup
+	for _, c := range []*Conn{client, server} {
+		wg.Add(1)
+		go func(c *Conn) {
+			defer wg.Done()
+			c.Run()
+			c.OnClose()
+		}(c)
+	}
+	t.Cleanup(func() {
+		a.Close()
+		wg.Wait()
+	})
+	return client, server
+}
+
+func TestCall(t *testing.T) {
+	reg := NewRegistry()
+	reg.Register("echo", func(_ context.Context, _ *Conn, req []byte) ([]byte, error) {
+		return append([]byte("echo "), req...), nil
+	})
+	client, _ := newPair(t, reg)
+
+	resp, err := client.Call(context.Background(), "echo", []byte("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != "echo hi" {
+		t.Errorf("response %q", resp)
+	}
+}
+
+func TestCallUnknownMethod(t *testing.T) {
+	client, _ := newPair(t, NewRegistry())
+
+	_, err := client.Call(context.Background(), "missing", nil)
+	var re *RemoteError
+	if !errors.As(err, &re) || re.Method != "missing" {
+		t.Errorf("error %v, want a RemoteError of missing", err)
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	reg := NewRegistry()
+	reg.Register("hang", func(context.Context, *Conn, []byte) ([]byte, error) {
+		<-block
+		return nil, nil
+	})
+	client, _ := newPair(t, reg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := client.Call(ctx, "hang", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error %v, want DeadlineExceeded", err)
+	}
+
+	client.mu.Lock()
+	pending := len(client.pending)
+	client.mu.Unlock()
+	if pending != 0 {
+		t.Errorf("%d calls still pending", pending)
+	}
+}
+
+func TestCallConnClosed(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	started := make(chan struct{})
+	reg := NewRegistry()
+	reg.Register("hang", func(context.Context, *Conn, []byte) ([]byte, error) {
+		close(started)
+		<-block
+		return nil, nil
+	})
+	client, server := newPair(t, reg)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := client.Call(context.Background(), "hang", nil)
+		errc <- err
+	}()
+	<-started
+	server.Conn().Close()
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("error %v, want ErrClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pending call not failed")
+	}
+
+	if _, err := client.Call(context.Background(), "hang", nil); !errors.Is(err, ErrClosed) {
+		t.Errorf("call after close: %v, want ErrClosed", err)
+	}
+}
+
+func TestNotifyOrder(t *testing.T) {
+	const count = 100
+	got := make(chan byte, count)
+	reg := NewRegistry()
+	reg.RegisterNotify("note", func(_ *Conn, payload []byte) {
+		got <- payload[0]
+	})
+	reg.Register("echo", func(_ context.Context, _ *Conn, req []byte) ([]byte, error) {
+		return req, nil
+	})
+	client, _ := newPair(t, reg)
+
+	for i := 0; i < count; i++ {
+		if err := client.Notify("note", []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+		if i%10 == 0 {
+			if _, err := client.Call(context.Background(), "echo", []byte{byte(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for i := 0; i < count; i++ {
+		select {
+		case b := <-got:
+			if b != byte(i) {
+				t.Fatalf("notification %d handled at position %d", b, i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("notification %d not handled", i)
+		}
+	}
+}
+
+func TestNotifyDoesNotBlockCalls(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	reg := NewRegistry()
+	reg.RegisterNotify("hang", func(*Conn, []byte) {
+		<-block
+	})
+	reg.Register("echo", func(_ context.Context, _ *Conn, req []byte) ([]byte, error) {
+		return req, nil
+	})
+	client, _ := newPair(t, reg)
+
+	client.Notify("hang", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := client.Call(ctx, "echo", nil); err != nil {
+		t.Errorf("call behind a blocked notification: %v", err)
+	}
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	var running, peak atomic.Int32
+	reg := NewRegistry()
+	reg.MaxConcurrent = 2
+	reg.Register("slow", func(context.Context, *Conn, []byte) ([]byte, error) {
+		n := running.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		running.Add(-1)
+		return nil, nil
+	})
+	client, _ := newPair(t, reg)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.Call(context.Background(), "slow", nil); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if p := peak.Load(); p != 2 {
+		t.Errorf("%d requests served at once, want 2", p)
+	}
+}
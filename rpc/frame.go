@@ -0,0 +1,72 @@
+package rpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Frame kinds, the first byte of every rpc frame.
+const (
+	kindRequest  byte = 1
+	kindResponse byte = 2
+	kindError    byte = 3
+	kindNotify   byte = 4
+)
+
+// A frame is [kind 1][seq 4][method len 1][method][payload]. Responses
+// and errors carry no method, notifications have seq 0.
+const seqSize = 4
+
+var errShortFrame = errors.New("rpc frame too short")
+
+type frame struct {
+	kind    byte
+	seq     uint32
+	method  string
+	payload []byte
+}
+
+// packHeader returns the frame header, the payload is written after it.
+func packHeader(kind byte, seq uint32, method string) ([]byte, error) {
+	if len(method) > math.MaxUint8 {
+		return nil, fmt.Errorf("method name %q longer than %d bytes", method, math.MaxUint8)
+	}
+
+	n := 1 + seqSize
+	if kind == kindRequest || kind == kindNotify {
+		n += 1 + len(method)
+	}
+	header := make([]byte, n)
+	header[0] = kind
+	binary.BigEndian.PutUint32(header[1:], seq)
+	if kind == kindRequest || kind == kindNotify {
+		header[1+seqSize] = byte(len(method))
+		copy(header[2+seqSize:], method)
+	}
+	return header, nil
+}
+
+func unpackFrame(msg []byte) (f frame, err error) {
+	if len(msg) < 1+seqSize {
+		return f, errShortFrame
+	}
+	f.kind = msg[0]
+	f.seq = binary.BigEndian.Uint32(msg[1:])
+	rest := msg[1+seqSize:]
+
+	switch f.kind {
+	case kindRequest, kindNotify:
+		if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+			return f, errShortFrame
+		}
+		f.method = string(rest[1 : 1+rest[0]])
+		rest = rest[1+rest[0]:]
+	case kindResponse, kindError:
+	default:
+		return f, fmt.Errorf("unknown rpc frame kind %d", f.kind)
+	}
+	f.payload = rest
+	return f, nil
+}
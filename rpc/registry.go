@@ -0,0 +1,106 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/gzjjyz/netlib"
+)
+
+// Handler answers a request. A returned error is sent to the caller as a
+// RemoteError. ctx is cancelled when the connection closes.
+type Handler func(ctx context.Context, conn *Conn, req []byte) ([]byte, error)
+
+// NotifyHandler handles a one-way notification.
+type NotifyHandler func(conn *Conn, payload []byte)
+
+// Registry maps method names to handlers. One registry may serve any
+// number of connections.
+type Registry struct {
+	mu       sync.RWMutex
+	handlers map[string]Handler
+	notifies map[string]NotifyHandler
+
+	// OnClose is called once the agent of conn stops running, after its
+	// pending calls have failed.
+	OnClose func(conn *Conn)
+	// MaxConcurrent bounds the requests each connection serves at once, 64
+	// when zero. Reading stops while every slot is taken, so a handler
+	// must not wait then for a call answered over its own connection.
+	MaxConcurrent int
+}
+
+const defaultMaxConcurrent = 64
+
+func (r *Registry) maxConcurrent() int {
+	if r.MaxConcurrent > 0 {
+		return r.MaxConcurrent
+	}
+	return defaultMaxConcurrent
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		handlers: make(map[string]Handler),
+		notifies: make(map[string]NotifyHandler),
+	}
+}
+
+func (r *Registry) Register(method string, handler Handler) error {
+	if handler == nil {
+		return errors.New("handler must not be nil")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.handlers[method]; ok {
+		return fmt.Errorf("method %q already registered", method)
+	}
+	r.handlers[method] = handler
+	return nil
+}
+
+func (r *Registry) RegisterNotify(method string, handler NotifyHandler) error {
+	if handler == nil {
+		return errors.New("handler must not be nil")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.notifies[method]; ok {
+		return fmt.Errorf("notification %q already registered", method)
+	}
+	r.notifies[method] = handler
+	return nil
+}
+
+func (r *Registry) Unregister(method string) {
+	r.mu.Lock()
+	delete(r.handlers, method)
+	delete(r.notifies, method)
+	r.mu.Unlock()
+}
+
+func (r *Registry) handler(method string) (Handler, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	h, ok := r.handlers[method]
+	return h, ok
+}
+
+func (r *Registry) notifyHandler(method string) (NotifyHandler, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	h, ok := r.notifies[method]
+	return h, ok
+}
+
+// NewAgent returns an rpc connection serving conn, which is also its
+// agent. It fits the NewAgent hook of both TCPServer and WSServer:
+//
+//	func(conn *netlib.TCPConn) netlib.Agent { return reg.NewAgent(conn) }
+func (r *Registry) NewAgent(conn netlib.Conn) netlib.Agent {
+	return NewConn(conn, r)
+}
@@ -0,0 +1,111 @@
+// Package rudp implements a reliable, ordered byte stream over UDP in the
+// style of KCP: an ARQ with selective and cumulative acks, fast retransmit
+// and a fixed window, tuned for latency rather than bandwidth.
+package rudp
+
+import (
+	"time"
+)
+
+const (
+	defaultWindow       = 128
+	defaultInterval     = 10 * time.Millisecond
+	defaultMTU          = 1400
+	defaultDeadLink     = 20
+	defaultIdleTimeout  = 60 * time.Second
+	defaultCloseTimeout = 5 * time.Second
+	defaultDialTimeout  = 10 * time.Second
+)
+
+// maxWindow is the largest window a segment header carries.
+const maxWindow = 65535
+
+type Config struct {
+	// Window is the send and receive window in segments, 128 when zero.
+	// Larger values than 65535 are cut to 65535, the largest window the
+	// segment header carries.
+	Window int
+	// NoDelay sends writes and acks right away instead of on the next
+	// tick, lowers the minimum retransmission timeout from 100ms to 30ms
+	// and backs off by 1.5 instead of 2 on every retransmission.
+	NoDelay bool
+	// Interval is the tick of retransmission checks and delayed flushes,
+	// 10ms when zero.
+	Interval time.Duration
+	// FastResend retransmits a segment once that many later segments have
+	// been acked, zero disables fast retransmit.
+	FastResend int
+	// MTU bounds the size of datagrams, 1400 when zero.
+	MTU int
+	// DeadLink is how many times a segment is retransmitted before the
+	// link is considered dead, 20 when zero.
+	DeadLink int
+	// IdleTimeout closes connections which received nothing for that long,
+	// 60 seconds when zero and never when negative.
+	IdleTimeout time.Duration
+	// CloseTimeout bounds delivering pending data after Close, 5 seconds
+	// when zero.
+	CloseTimeout time.Duration
+	// DialTimeout bounds Dial waiting for the server, 10 seconds when zero.
+	DialTimeout time.Duration
+}
+
+func (cfg *Config) window() int {
+	if cfg.Window > maxWindow {
+		return maxWindow
+	}
+	if cfg.Window > 0 {
+		return cfg.Window
+	}
+	return defaultWindow
+}
+
+func (cfg *Config) interval() time.Duration {
+	if cfg.Interval > 0 {
+		return cfg.Interval
+	}
+	return defaultInterval
+}
+
+func (cfg *Config) mtu() int {
+	if cfg.MTU > headerSize {
+		return cfg.MTU
+	}
+	return defaultMTU
+}
+
+func (cfg *Config) deadLink() uint32 {
+	if cfg.DeadLink > 0 {
+		return uint32(cfg.DeadLink)
+	}
+	return defaultDeadLink
+}
+
+func (cfg *Config) idleTimeout() time.Duration {
+	if cfg.IdleTimeout != 0 {
+		return cfg.IdleTimeout
+	}
+	return defaultIdleTimeout
+}
+
+func (cfg *Config) closeTimeout() time.Duration {
+	if cfg.CloseTimeout > 0 {
+		return cfg.CloseTimeout
+	}
+	return defaultCloseTimeout
+}
+
+func (cfg *Config) dialTimeout() time.Duration {
+	if cfg.DialTimeout > 0 {
+		return cfg.DialTimeout
+	}
+	return defaultDialTimeout
+}
+
+// minRTO is the lower bound of the retransmission timeout in milliseconds.
+func (cfg *Config) minRTO() uint32 {
+	if cfg.NoDelay {
+		return 30
+	}
+	return 100
+}
@@ -0,0 +1,589 @@
+package rudp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrDeadLink is returned once a segment was retransmitted Config.DeadLink
+// times without being acked.
+var ErrDeadLink = errors.New("dead link")
+
+// errTimeout is returned when a deadline or the idle timeout expires.
+var errTimeout net.Error = timeoutError{}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+type ackItem struct {
+	sn uint32
+	ts uint32
+}
+
+// Conn is one end of a reliable stream. It implements net.Conn.
+type Conn struct {
+	cfg   *Config
+	conv  uint32
+	pc    net.PacketConn
+	raddr net.Addr
+
+	mu sync.Mutex
+	// send side
+	sndNxt     uint32
+	sndPending []byte
+	sndBuf     []*segment
+	rmtWnd     uint32
+	finSent    bool
+	// round trip estimation, in milliseconds
+	srtt   uint32
+	rttvar uint32
+	rto    uint32
+	// receive side
+	rcvNxt   uint32
+	rcvBuf   map[uint32]*segment
+	rcvQueue [][]byte
+	eof      bool
+	acks     []ackItem
+	lastRecv time.Time
+
+	out         []byte
+	established bool
+	closed      bool
+	closedAt    time.Time
+	err         error
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	readable    chan struct{}
+	writable    chan struct{}
+	connected   chan struct{}
+	released    chan struct{}
+	releaseOnce sync.Once
+	onRelease   func()
+}
+
+func newConn(pc net.PacketConn, raddr net.Addr, conv uint32, cfg *Config, client bool, onRelease func()) *Conn {
+	c := &Conn{
+		cfg:       cfg,
+		conv:      conv,
+		pc:        pc,
+		raddr:     raddr,
+		rmtWnd:    uint32(cfg.window()),
+		rto:       200,
+		rcvBuf:    make(map[uint32]*segment),
+		lastRecv:  time.Now(),
+		readable:  make(chan struct{}, 1),
+		writable:  make(chan struct{}, 1),
+		connected: make(chan struct{}),
+		released:  make(chan struct{}),
+		onRelease: onRelease,
+	}
+	if c.rto < cfg.minRTO() {
+		c.rto = cfg.minRTO()
+	}
+
+	if client {
+		// the empty segment 0 opens the connection on the server
+		c.sndBuf = append(c.sndBuf, &segment{conv: conv, cmd: cmdPush})
+		c.sndNxt = 1
+	} else {
+		c.established = true
+		close(c.connected)
+	}
+
+	go c.update()
+	return c
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Conn) mss() int {
+	return c.cfg.mtu() - headerSize
+}
+
+func (c *Conn) update() {
+	ticker := time.NewTicker(c.cfg.interval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.released:
+			return
+		}
+
+		c.mu.Lock()
+		c.flush()
+		done := c.finished()
+		c.mu.Unlock()
+
+		if done {
+			c.release()
+		}
+	}
+}
+
+// finished reports whether the connection should be released, c.mu must
+// be held.
+func (c *Conn) finished() bool {
+	if c.err != nil {
+		return true
+	}
+	if idle := c.cfg.idleTimeout(); idle > 0 && time.Since(c.lastRecv) > idle {
+		c.err = errTimeout
+		return true
+	}
+	if c.closed {
+		// wait for the peer to close too so its fin gets acked
+		if c.finSent && len(c.sndBuf) == 0 && c.eof {
+			return true
+		}
+		return time.Since(c.closedAt) > c.cfg.closeTimeout()
+	}
+	return false
+}
+
+// release ends the connection, pending data is discarded.
+func (c *Conn) release() {
+	c.releaseOnce.Do(func() {
+		c.mu.Lock()
+		if c.err == nil {
+			c.err = net.ErrClosed
+		}
+		c.mu.Unlock()
+
+		close(c.released)
+		if c.onRelease != nil {
+			c.onRelease()
+		}
+	})
+}
+
+func (c *Conn) rcvWndFree() uint16 {
+	free := c.cfg.window() - len(c.rcvQueue)
+	if free < 0 {
+		return 0
+	}
+	return uint16(free)
+}
+
+// flush sends pending acks, new segments within the windows and
+// retransmissions, c.mu must be held.
+func (c *Conn) flush() {
+	if c.err != nil {
+		return
+	}
+
+	current := currentMs()
+	mtu := c.cfg.mtu()
+	wnd := c.rcvWndFree()
+	buf := c.out[:0]
+	emit := func(seg *segment) {
+		if len(buf)+headerSize+len(seg.data) > mtu {
+			c.output(buf)
+			buf = buf[:0]
+		}
+		buf = seg.encode(buf)
+	}
+
+	ack := segment{conv: c.conv, cmd: cmdAck, wnd: wnd, una: c.rcvNxt}
+	for _, a := range c.acks {
+		ack.sn, ack.ts = a.sn, a.ts
+		emit(&ack)
+	}
+	c.acks = c.acks[:0]
+
+	// keep one segment in flight even if the peer window is closed, its
+	// retransmissions probe for the window to open
+	limit := c.cfg.window()
+	if rw := int(c.rmtWnd); rw < limit {
+		limit = rw
+		if limit < 1 {
+			limit = 1
+		}
+	}
+	moved := false
+	for len(c.sndBuf) < limit {
+		seg := &segment{conv: c.conv, cmd: cmdPush, sn: c.sndNxt}
+		if len(c.sndPending) > 0 {
+			k := c.mss()
+			if k > len(c.sndPending) {
+				k = len(c.sndPending)
+			}
+			seg.data = append([]byte(nil), c.sndPending[:k]...)
+			c.sndPending = c.sndPending[k:]
+			moved = true
+		} else if c.closed && !c.finSent {
+			seg.cmd = cmdFin
+			c.finSent = true
+		} else {
+			break
+		}
+		c.sndNxt++
+		c.sndBuf = append(c.sndBuf, seg)
+	}
+	if moved {
+		if len(c.sndPending) == 0 {
+			c.sndPending = nil
+		}
+		notify(c.writable)
+	}
+
+	for _, seg := range c.sndBuf {
+		switch {
+		case seg.xmit == 0:
+			seg.rto = c.rto
+		case seqDiff(current, seg.resendts) >= 0:
+			if c.cfg.NoDelay {
+				seg.rto += seg.rto / 2
+			} else {
+				seg.rto *= 2
+			}
+			if seg.rto > maxRTO {
+				seg.rto = maxRTO
+			}
+		case c.cfg.FastResend > 0 && seg.fastack >= uint32(c.cfg.FastResend) && seg.xmit <= fastResendLimit:
+			seg.fastack = 0
+		default:
+			continue
+		}
+
+		seg.xmit++
+		if seg.xmit > c.cfg.deadLink() {
+			c.err = ErrDeadLink
+			break
+		}
+		seg.resendts = current + seg.rto
+		seg.ts = current
+		seg.wnd = wnd
+		seg.una = c.rcvNxt
+		emit(seg)
+	}
+
+	if len(buf) > 0 {
+		c.output(buf)
+	}
+	c.out = buf[:0]
+}
+
+func (c *Conn) output(b []byte) {
+	// losses are recovered by retransmission
+	c.pc.WriteTo(b, c.raddr)
+}
+
+func (c *Conn) updateRTT(rtt uint32) {
+	if c.srtt == 0 {
+		c.srtt = rtt
+		c.rttvar = rtt / 2
+	} else {
+		delta := rtt - c.srtt
+		if rtt < c.srtt {
+			delta = c.srtt - rtt
+		}
+		c.rttvar = (3*c.rttvar + delta) / 4
+		c.srtt = (7*c.srtt + rtt) / 8
+		if c.srtt < 1 {
+			c.srtt = 1
+		}
+	}
+
+	variance := 4 * c.rttvar
+	if interval := uint32(c.cfg.interval() / time.Millisecond); variance < interval {
+		variance = interval
+	}
+	c.rto = c.srtt + variance
+	if c.rto < c.cfg.minRTO() {
+		c.rto = c.cfg.minRTO()
+	} else if c.rto > maxRTO {
+		c.rto = maxRTO
+	}
+}
+
+// ackUntil drops the segments before una, which the peer has received.
+func (c *Conn) ackUntil(una uint32) {
+	i := 0
+	for i < len(c.sndBuf) && seqDiff(c.sndBuf[i].sn, una) < 0 {
+		c.sndBuf[i] = nil
+		i++
+	}
+	c.sndBuf = c.sndBuf[i:]
+}
+
+func (c *Conn) ackOne(sn uint32) {
+	for i, seg := range c.sndBuf {
+		if seg.sn == sn {
+			copy(c.sndBuf[i:], c.sndBuf[i+1:])
+			c.sndBuf[len(c.sndBuf)-1] = nil
+			c.sndBuf = c.sndBuf[:len(c.sndBuf)-1]
+			return
+		}
+		if seqDiff(seg.sn, sn) > 0 {
+			return
+		}
+	}
+}
+
+// input processes a datagram from the peer.
+func (c *Conn) input(data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+
+	current := currentMs()
+	c.lastRecv = time.Now()
+	window := uint32(c.cfg.window())
+	var maxack, maxackTs uint32
+	acked, pushed := false, false
+
+	for {
+		seg, rest, ok := decodeSegment(data)
+		if !ok {
+			break
+		}
+		data = rest
+		if seg.conv != c.conv {
+			continue
+		}
+
+		c.rmtWnd = uint32(seg.wnd)
+		c.ackUntil(seg.una)
+
+		switch seg.cmd {
+		case cmdAck:
+			if rtt := seqDiff(current, seg.ts); rtt >= 0 {
+				c.updateRTT(uint32(rtt))
+			}
+			c.ackOne(seg.sn)
+			if !acked || seqDiff(seg.sn, maxack) > 0 {
+				maxack, maxackTs = seg.sn, seg.ts
+				acked = true
+			}
+		case cmdPush, cmdFin:
+			if seqDiff(seg.sn, c.rcvNxt+window) >= 0 {
+				// beyond the window, the peer will retransmit it
+				continue
+			}
+			c.acks = append(c.acks, ackItem{sn: seg.sn, ts: seg.ts})
+			if _, dup := c.rcvBuf[seg.sn]; !dup && seqDiff(seg.sn, c.rcvNxt) >= 0 {
+				c.rcvBuf[seg.sn] = &segment{
+					cmd:  seg.cmd,
+					sn:   seg.sn,
+					data: append([]byte(nil), seg.data...),
+				}
+			}
+			pushed = true
+		}
+	}
+
+	if acked {
+		// segments sent before a later one that was acked were likely lost
+		for _, seg := range c.sndBuf {
+			if seqDiff(seg.sn, maxack) >= 0 {
+				break
+			}
+			if seqDiff(seg.ts, maxackTs) <= 0 {
+				seg.fastack++
+			}
+		}
+	}
+	if pushed {
+		c.deliver()
+	}
+	if !c.established && (len(c.sndBuf) == 0 || c.sndBuf[0].sn != 0) {
+		c.established = true
+		close(c.connected)
+	}
+	if c.cfg.NoDelay && (len(c.acks) > 0 || acked) {
+		c.flush()
+	}
+}
+
+// deliver moves in order segments to the read queue, c.mu must be held.
+func (c *Conn) deliver() {
+	moved := false
+	for !c.eof && len(c.rcvQueue) < c.cfg.window() {
+		seg, ok := c.rcvBuf[c.rcvNxt]
+		if !ok {
+			break
+		}
+		delete(c.rcvBuf, c.rcvNxt)
+		c.rcvNxt++
+		moved = true
+
+		if seg.cmd == cmdFin {
+			c.eof = true
+		} else if len(seg.data) > 0 {
+			c.rcvQueue = append(c.rcvQueue, seg.data)
+		}
+	}
+	if moved {
+		notify(c.readable)
+	}
+}
+
+// wait blocks until ch is signalled, the connection is released or the
+// deadline passes.
+func (c *Conn) wait(ch <-chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return errTimeout
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-ch:
+	case <-c.released:
+	case <-timeout:
+		return errTimeout
+	}
+	return nil
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		if len(c.rcvQueue) > 0 {
+			n := 0
+			for n < len(b) && len(c.rcvQueue) > 0 {
+				k := copy(b[n:], c.rcvQueue[0])
+				n += k
+				if k == len(c.rcvQueue[0]) {
+					c.rcvQueue[0] = nil
+					c.rcvQueue = c.rcvQueue[1:]
+				} else {
+					c.rcvQueue[0] = c.rcvQueue[0][k:]
+				}
+			}
+			// room in the queue lets buffered segments through
+			c.deliver()
+			c.mu.Unlock()
+			return n, nil
+		}
+		if c.eof {
+			c.mu.Unlock()
+			return 0, io.EOF
+		}
+		if c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			return 0, err
+		}
+		deadline := c.readDeadline
+		c.mu.Unlock()
+
+		if err := c.wait(c.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write queues b for sending. It blocks while a window's worth of data is
+// waiting to be sent.
+func (c *Conn) Write(b []byte) (int, error) {
+	n := 0
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return n, net.ErrClosed
+		}
+		if c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			return n, err
+		}
+
+		if room := c.cfg.window()*c.mss() - len(c.sndPending); room > 0 {
+			k := len(b) - n
+			if k > room {
+				k = room
+			}
+			c.sndPending = append(c.sndPending, b[n:n+k]...)
+			n += k
+			if c.cfg.NoDelay {
+				c.flush()
+			}
+		}
+		deadline := c.writeDeadline
+		c.mu.Unlock()
+
+		if n == len(b) {
+			return n, nil
+		}
+		if err := c.wait(c.writable, deadline); err != nil {
+			return n, err
+		}
+	}
+}
+
+// Close stops reads and writes. Data already written is still delivered,
+// up to Config.CloseTimeout, before the peer is told the stream ended.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.closedAt = time.Now()
+	if c.cfg.NoDelay {
+		c.flush()
+	}
+	c.mu.Unlock()
+
+	notify(c.readable)
+	notify(c.writable)
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.pc.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	notify(c.readable)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	notify(c.writable)
+	return nil
+}
@@ -0,0 +1,153 @@
+package rudp
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLossyTransfer(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  Config
+	}{
+		{"default", Config{}},
+		{"nodelay", Config{NoDelay: true, FastResend: 2}},
+	} {
+		cfg := tc.cfg
+		t.Run(tc.name, func(t *testing.T) {
+			testLossyTransfer(t, &cfg, 0.1)
+		})
+	}
+}
+
+func testLossyTransfer(t *testing.T, cfg *Config, loss float64) {
+	spc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := NewListener(NewLossyPacketConn(spc, loss), cfg)
+	defer ln.Close()
+
+	cpc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := DialPacketConn(NewLossyPacketConn(cpc, loss), spc.LocalAddr(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	payload := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(payload)
+
+	errc := make(chan error, 1)
+	go func() {
+		// uneven writes so segments do not line up with them
+		for off := 0; off < len(payload); {
+			n := 1 + rand.Intn(5000)
+			if off+n > len(payload) {
+				n = len(payload) - off
+			}
+			if _, err := client.Write(payload[off : off+n]); err != nil {
+				errc <- err
+				return
+			}
+			off += n
+		}
+		errc <- nil
+	}()
+
+	server.SetReadDeadline(time.Now().Add(30 * time.Second))
+	got := make([]byte, len(payload))
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		for i := range got {
+			if got[i] != payload[i] {
+				t.Fatalf("payload differs from byte %d", i)
+			}
+		}
+	}
+}
+
+func TestWindowLimit(t *testing.T) {
+	for _, window := range []int{0, 128, 65535, 65536, 1 << 20} {
+		c := &Conn{cfg: &Config{Window: window}}
+		if free := c.rcvWndFree(); free == 0 {
+			t.Errorf("window %d advertises no room", window)
+		}
+	}
+}
+
+func TestReleasedConnNotReopened(t *testing.T) {
+	spc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := NewListener(spc, nil)
+	defer ln.Close()
+
+	cpc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cpc.Close()
+	open := func(conv uint32) {
+		seg := segment{conv: conv, cmd: cmdPush}
+		if _, err := cpc.WriteTo(seg.encode(nil), spc.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+	accept := func() net.Conn {
+		select {
+		case c := <-accepted:
+			return c
+		case <-time.After(200 * time.Millisecond):
+			return nil
+		}
+	}
+
+	open(7)
+	c := accept()
+	if c == nil {
+		t.Fatal("opening segment not accepted")
+	}
+	c.(*Conn).release()
+
+	// a late retransmission of the opening segment
+	open(7)
+	if c := accept(); c != nil {
+		t.Fatal("released connection accepted again")
+	}
+
+	// a new connection from the same address
+	open(8)
+	if c := accept(); c == nil {
+		t.Fatal("new connection not accepted")
+	}
+}
@@ -0,0 +1,69 @@
+package rudp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+// Dial connects to the UDP address and waits for the server to answer.
+func Dial(address string, cfg *Config) (*Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return nil, err
+	}
+	return DialPacketConn(pc, raddr, cfg)
+}
+
+// DialPacketConn connects to raddr over pc, e.g. a LossyPacketConn. pc is
+// owned by the connection and closed with it, also when dialing fails.
+func DialPacketConn(pc net.PacketConn, raddr net.Addr, cfg *Config) (*Conn, error) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		pc.Close()
+		return nil, err
+	}
+	c := newConn(pc, raddr, binary.LittleEndian.Uint32(b[:]), cfg, true, func() { pc.Close() })
+
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				continue
+			}
+			if addr.String() != raddr.String() {
+				continue
+			}
+			c.input(buf[:n])
+		}
+	}()
+
+	timer := time.NewTimer(cfg.dialTimeout())
+	defer timer.Stop()
+	select {
+	case <-c.connected:
+		return c, nil
+	case <-c.released:
+		c.mu.Lock()
+		err := c.err
+		c.mu.Unlock()
+		return nil, err
+	case <-timer.C:
+		c.release()
+		return nil, errTimeout
+	}
+}
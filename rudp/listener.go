@@ -0,0 +1,165 @@
+package rudp
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// acceptBacklog bounds the connections waiting for Accept, new ones are
+// ignored while it is full and the client retries.
+const acceptBacklog = 128
+
+// tombstoneTTL is how long the opening segments of a released connection
+// are ignored, so a late retransmission does not open it again.
+const tombstoneTTL = time.Minute
+
+// maxDatagramSize is the read buffer size, larger datagrams are truncated.
+const maxDatagramSize = 64 * 1024
+
+// Listener accepts connections on one UDP socket. It implements
+// net.Listener.
+type Listener struct {
+	pc    net.PacketConn
+	cfg   *Config
+	mu    sync.Mutex
+	conns map[string]*Conn
+	// released holds when the connections released lately ended
+	released map[connKey]time.Time
+	swept    time.Time
+	accept   chan *Conn
+	closed   bool
+	die      chan struct{}
+}
+
+type connKey struct {
+	addr string
+	conv uint32
+}
+
+// Listen announces on the UDP address.
+func Listen(address string, cfg *Config) (*Listener, error) {
+	pc, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return NewListener(pc, cfg), nil
+}
+
+// NewListener accepts connections over pc. pc is closed once the listener
+// and every connection it accepted are closed.
+func NewListener(pc net.PacketConn, cfg *Config) *Listener {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	l := &Listener{
+		pc:       pc,
+		cfg:      cfg,
+		conns:    make(map[string]*Conn),
+		released: make(map[connKey]time.Time),
+		accept:   make(chan *Conn, acceptBacklog),
+		die:      make(chan struct{}),
+	}
+	go l.readLoop()
+	return l
+}
+
+func (l *Listener) readLoop() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		key := addr.String()
+		l.mu.Lock()
+		c := l.conns[key]
+		if c == nil && !l.closed && len(l.accept) < cap(l.accept) {
+			// only the opening segment creates a connection, stray
+			// segments of released ones are ignored
+			seg, _, ok := decodeSegment(buf[:n])
+			if ok && seg.cmd == cmdPush && seg.sn == 0 && !l.isReleased(key, seg.conv) {
+				conv := seg.conv
+				c = newConn(l.pc, addr, conv, l.cfg, false, func() { l.remove(key, conv) })
+				l.conns[key] = c
+				l.accept <- c
+			}
+		}
+		l.mu.Unlock()
+
+		if c != nil {
+			c.input(buf[:n])
+		}
+	}
+}
+
+func (l *Listener) remove(key string, conv uint32) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if c := l.conns[key]; c != nil && c.conv == conv {
+		delete(l.conns, key)
+	}
+	now := time.Now()
+	l.released[connKey{key, conv}] = now
+	if now.Sub(l.swept) > tombstoneTTL {
+		for k, at := range l.released {
+			if now.Sub(at) > tombstoneTTL {
+				delete(l.released, k)
+			}
+		}
+		l.swept = now
+	}
+	if l.closed && len(l.conns) == 0 {
+		l.pc.Close()
+	}
+}
+
+// isReleased reports whether the connection conv from key was released
+// lately, l.mu must be held.
+func (l *Listener) isReleased(key string, conv uint32) bool {
+	at, ok := l.released[connKey{key, conv}]
+	return ok && time.Since(at) <= tombstoneTTL
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.die:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting. Connections already accepted keep working.
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.die)
+	if len(l.conns) == 0 {
+		l.pc.Close()
+	}
+	l.mu.Unlock()
+
+	// drop the connections nobody will accept
+	for {
+		select {
+		case c := <-l.accept:
+			c.release()
+		default:
+			return nil
+		}
+	}
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.pc.LocalAddr()
+}
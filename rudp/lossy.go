@@ -0,0 +1,37 @@
+package rudp
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// LossyPacketConn drops outgoing datagrams at random, to exercise
+// retransmission on loopback.
+type LossyPacketConn struct {
+	net.PacketConn
+	mu   sync.Mutex
+	rnd  *rand.Rand
+	loss float64
+}
+
+// NewLossyPacketConn drops the given fraction, 0 to 1, of the datagrams
+// written to pc.
+func NewLossyPacketConn(pc net.PacketConn, loss float64) *LossyPacketConn {
+	return &LossyPacketConn{
+		PacketConn: pc,
+		rnd:        rand.New(rand.NewSource(time.Now().UnixNano())),
+		loss:       loss,
+	}
+}
+
+func (l *LossyPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	l.mu.Lock()
+	drop := l.rnd.Float64() < l.loss
+	l.mu.Unlock()
+	if drop {
+		return len(b), nil
+	}
+	return l.PacketConn.WriteTo(b, addr)
+}
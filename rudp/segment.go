@@ -0,0 +1,85 @@
+package rudp
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+const (
+	// cmdPush carries stream data, an empty push with sn 0 opens a connection
+	cmdPush byte = 1
+	// cmdAck acknowledges one segment
+	cmdAck byte = 2
+	// cmdFin ends the stream, it is sequenced and acked like a push
+	cmdFin byte = 3
+)
+
+// headerSize is conv(4) cmd(1) wnd(2) ts(4) sn(4) una(4) len(2).
+const headerSize = 21
+
+// maxRTO is the upper bound of the retransmission timeout in milliseconds.
+const maxRTO = 60000
+
+// fastResendLimit stops fast retransmits of a segment after that many
+// transmissions, leaving it to the retransmission timeout.
+const fastResendLimit = 5
+
+type segment struct {
+	conv uint32
+	cmd  byte
+	wnd  uint16
+	ts   uint32
+	sn   uint32
+	una  uint32
+	data []byte
+
+	// sender bookkeeping
+	resendts uint32
+	rto      uint32
+	fastack  uint32
+	xmit     uint32
+}
+
+func (seg *segment) encode(b []byte) []byte {
+	var h [headerSize]byte
+	binary.LittleEndian.PutUint32(h[0:], seg.conv)
+	h[4] = seg.cmd
+	binary.LittleEndian.PutUint16(h[5:], seg.wnd)
+	binary.LittleEndian.PutUint32(h[7:], seg.ts)
+	binary.LittleEndian.PutUint32(h[11:], seg.sn)
+	binary.LittleEndian.PutUint32(h[15:], seg.una)
+	binary.LittleEndian.PutUint16(h[19:], uint16(len(seg.data)))
+	b = append(b, h[:]...)
+	return append(b, seg.data...)
+}
+
+// decodeSegment reads the segment at the start of b. data aliases b.
+func decodeSegment(b []byte) (seg segment, rest []byte, ok bool) {
+	if len(b) < headerSize {
+		return seg, nil, false
+	}
+	seg.conv = binary.LittleEndian.Uint32(b[0:])
+	seg.cmd = b[4]
+	seg.wnd = binary.LittleEndian.Uint16(b[5:])
+	seg.ts = binary.LittleEndian.Uint32(b[7:])
+	seg.sn = binary.LittleEndian.Uint32(b[11:])
+	seg.una = binary.LittleEndian.Uint32(b[15:])
+	n := int(binary.LittleEndian.Uint16(b[19:]))
+	if len(b) < headerSize+n {
+		return seg, nil, false
+	}
+	seg.data = b[headerSize : headerSize+n]
+	return seg, b[headerSize+n:], true
+}
+
+// seqDiff compares sequence numbers and timestamps across wraparound.
+func seqDiff(a, b uint32) int32 {
+	return int32(a - b)
+}
+
+var epoch = time.Now()
+
+// currentMs is the clock of segment timestamps.
+func currentMs() uint32 {
+	return uint32(time.Since(epoch) / time.Millisecond)
+}
@@ -0,0 +1,62 @@
+package secure
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"net"
+	"time"
+)
+
+const (
+	defaultHandshakeTimeout = 10 * time.Second
+	defaultMaxRecordSize    = 16 << 10
+)
+
+type Config struct {
+	// PSK is mixed into the key derivation, so peers holding different
+	// keys fail the handshake. Without it the key exchange is anonymous and
+	// does not resist an active man in the middle.
+	PSK []byte
+	// NewAEAD builds the cipher of one direction from a 32-byte key,
+	// AES-256-GCM when nil. Plug ChaCha20-Poly1305 in here.
+	NewAEAD func(key []byte) (cipher.AEAD, error)
+	// HandshakeTimeout bounds the handshake, 10 seconds when zero.
+	HandshakeTimeout time.Duration
+	// MaxRecordSize caps the plaintext carried by one record, 16 KiB when zero.
+	MaxRecordSize int
+}
+
+func (cfg *Config) newAEAD(key []byte) (cipher.AEAD, error) {
+	if cfg.NewAEAD != nil {
+		return cfg.NewAEAD(key)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (cfg *Config) handshakeTimeout() time.Duration {
+	if cfg.HandshakeTimeout > 0 {
+		return cfg.HandshakeTimeout
+	}
+	return defaultHandshakeTimeout
+}
+
+func (cfg *Config) maxRecordSize() int {
+	if cfg.MaxRecordSize > 0 {
+		return cfg.MaxRecordSize
+	}
+	return defaultMaxRecordSize
+}
+
+// ServerHandshake fits the Handshake hook of netlib.TCPServer.
+func (cfg *Config) ServerHandshake(conn net.Conn) (net.Conn, error) {
+	return Server(conn, cfg)
+}
+
+// ClientHandshake fits the Handshake hook of netlib.TCPClient.
+func (cfg *Config) ClientHandshake(conn net.Conn) (net.Conn, error) {
+	return Client(conn, cfg)
+}
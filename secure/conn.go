@@ -0,0 +1,177 @@
+package secure
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	lenSize    = 4
+	seqSize    = 8
+	headerSize = lenSize + seqSize
+)
+
+var (
+	ErrReplay    = errors.New("replayed or out of order record")
+	ErrDecrypt   = errors.New("record authentication failed")
+	ErrRecordLen = errors.New("invalid record length")
+)
+
+// halfConn holds the state of one direction.
+type halfConn struct {
+	aead cipher.AEAD
+	seq  uint64
+}
+
+func (hc *halfConn) nonce(seq uint64) []byte {
+	nonce := make([]byte, hc.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-seqSize:], seq)
+	return nonce
+}
+
+// Conn encrypts every write as one or more records:
+//
+//	| length uint32 | sequence uint64 | sealed payload |
+//
+// The sequence numbers the records of a direction from 0, it builds the
+// nonce and is authenticated with the payload. Records arriving with any
+// other sequence than the next expected one are rejected.
+type Conn struct {
+	conn          net.Conn
+	maxRecordSize int
+
+	writeMu sync.Mutex
+	out     halfConn
+
+	readMu  sync.Mutex
+	in      halfConn
+	pending []byte
+}
+
+func newConn(conn net.Conn, maxRecordSize int) *Conn {
+	return &Conn{
+		conn:          conn,
+		maxRecordSize: maxRecordSize,
+	}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for len(c.pending) == 0 {
+		record, err := c.readRecord()
+		if err != nil {
+			return 0, err
+		}
+		c.pending = record
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *Conn) readRecord() ([]byte, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(c.conn, header[:]); err != nil {
+		return nil, err
+	}
+
+	recordLen := binary.BigEndian.Uint32(header[:lenSize])
+	maxLen := seqSize + c.maxRecordSize + c.in.aead.Overhead()
+	if recordLen < uint32(seqSize+c.in.aead.Overhead()) || recordLen > uint32(maxLen) {
+		return nil, fmt.Errorf("%w %d", ErrRecordLen, recordLen)
+	}
+
+	seq := binary.BigEndian.Uint64(header[lenSize:])
+	if seq != c.in.seq {
+		return nil, fmt.Errorf("%w: got %d, want %d", ErrReplay, seq, c.in.seq)
+	}
+
+	sealed := make([]byte, recordLen-seqSize)
+	if _, err := io.ReadFull(c.conn, sealed); err != nil {
+		return nil, err
+	}
+
+	plain, err := c.in.aead.Open(sealed[:0], c.in.nonce(seq), sealed, header[lenSize:])
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	c.in.seq++
+	return plain, nil
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	var n int
+	for {
+		chunk := b
+		if len(chunk) > c.maxRecordSize {
+			chunk = chunk[:c.maxRecordSize]
+		}
+		if err := c.writeRecord(chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+		if len(b) == 0 {
+			return n, nil
+		}
+	}
+}
+
+func (c *Conn) writeRecord(plain []byte) error {
+	if c.out.seq == math.MaxUint64 {
+		return errors.New("record sequence exhausted")
+	}
+
+	record := make([]byte, headerSize, headerSize+len(plain)+c.out.aead.Overhead())
+	binary.BigEndian.PutUint32(record, uint32(seqSize+len(plain)+c.out.aead.Overhead()))
+	binary.BigEndian.PutUint64(record[lenSize:], c.out.seq)
+	record = c.out.aead.Seal(record, c.out.nonce(c.out.seq), plain, record[lenSize:headerSize])
+
+	if _, err := c.conn.Write(record); err != nil {
+		return err
+	}
+	c.out.seq++
+	return nil
+}
+
+// NetConn returns the underlying connection.
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
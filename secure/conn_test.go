@@ -0,0 +1,170 @@
+package secure
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// pair runs the handshake of both sides over net.Pipe.
+func pair(t *testing.T, clientCfg, serverCfg *Config) (client, server *Conn, clientErr, serverErr error) {
+	t.Helper()
+	cc, sc := net.Pipe()
+	t.Cleanup(func() {
+		cc.Close()
+		sc.Close()
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server, serverErr = Server(sc, serverCfg)
+		if serverErr != nil {
+			sc.Close()
+		}
+	}()
+	client, clientErr = Client(cc, clientCfg)
+	if clientErr != nil {
+		cc.Close()
+	}
+	<-done
+	return client, server, clientErr, serverErr
+}
+
+func TestHandshake(t *testing.T) {
+	cfg := &Config{PSK: []byte("secret")}
+	client, server, err1, err2 := pair(t, cfg, cfg)
+	if err1 != nil || err2 != nil {
+		t.Fatal(err1, err2)
+	}
+
+	go client.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("server read %q, %v", buf, err)
+	}
+
+	go server.Write([]byte("pong"))
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("client read %q, %v", buf, err)
+	}
+}
+
+func TestHandshakePSKMismatch(t *testing.T) {
+	_, _, err1, err2 := pair(t,
+		&Config{PSK: []byte("one"), HandshakeTimeout: time.Second},
+		&Config{PSK: []byte("two"), HandshakeTimeout: time.Second})
+	if !errors.Is(err1, ErrHandshake) {
+		t.Errorf("client error %v, want ErrHandshake", err1)
+	}
+	if err2 == nil {
+		t.Error("server handshake succeeded")
+	}
+}
+
+// recorder keeps every write, which Conn makes once per record.
+type recorder struct {
+	net.Conn
+	records [][]byte
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.records = append(r.records, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+// stream reads the given bytes.
+type stream struct {
+	net.Conn
+	r io.Reader
+}
+
+func (s *stream) Read(b []byte) (int, error) {
+	return s.r.Read(b)
+}
+
+func testAEAD(t *testing.T) cipher.AEAD {
+	block, err := aes.NewCipher(make([]byte, keySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead
+}
+
+// seal returns the records written for msgs.
+func seal(t *testing.T, maxRecordSize int, msgs ...[]byte) [][]byte {
+	rec := &recorder{}
+	c := newConn(rec, maxRecordSize)
+	c.out.aead = testAEAD(t)
+	for _, msg := range msgs {
+		if _, err := c.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec.records
+}
+
+// opener returns a Conn reading records in the given order.
+func opener(t *testing.T, maxRecordSize int, records ...[]byte) *Conn {
+	c := newConn(&stream{r: bytes.NewReader(bytes.Join(records, nil))}, maxRecordSize)
+	c.in.aead = testAEAD(t)
+	return c
+}
+
+func TestReplay(t *testing.T) {
+	records := seal(t, defaultMaxRecordSize, []byte("a"), []byte("b"))
+	buf := make([]byte, 1)
+
+	c := opener(t, defaultMaxRecordSize, records[0], records[0])
+	if _, err := c.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Read(buf); !errors.Is(err, ErrReplay) {
+		t.Errorf("replayed record: %v, want ErrReplay", err)
+	}
+
+	c = opener(t, defaultMaxRecordSize, records[1], records[0])
+	if _, err := c.Read(buf); !errors.Is(err, ErrReplay) {
+		t.Errorf("reordered record: %v, want ErrReplay", err)
+	}
+}
+
+func TestTamper(t *testing.T) {
+	records := seal(t, defaultMaxRecordSize, []byte("hello"))
+	records[0][len(records[0])-1] ^= 1
+
+	c := opener(t, defaultMaxRecordSize, records...)
+	if _, err := c.Read(make([]byte, 5)); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("tampered record: %v, want ErrDecrypt", err)
+	}
+}
+
+func TestLargeWrite(t *testing.T) {
+	const maxRecordSize = 1000
+	msg := make([]byte, 10*maxRecordSize+500)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+
+	records := seal(t, maxRecordSize, msg)
+	if len(records) != 11 {
+		t.Errorf("%d records, want 11", len(records))
+	}
+
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(opener(t, maxRecordSize, records...), got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Error("reassembled message differs")
+	}
+}
@@ -0,0 +1,154 @@
+package secure
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	version = 1
+	keySize = 32
+)
+
+var (
+	label          = []byte("netlib secure v1")
+	clientFinished = []byte("client finished")
+	serverFinished = []byte("server finished")
+
+	ErrHandshake = errors.New("secure handshake failed")
+)
+
+// Server runs the server side of the handshake on conn and returns the
+// encrypted connection.
+//
+// The client sends its X25519 public key, the server answers with its own
+// followed by an encrypted finished record, and the client completes with
+// its finished record. Keys for each direction are derived from the shared
+// secret, the PSK and both public keys.
+func Server(conn net.Conn, cfg *Config) (*Conn, error) {
+	return handshake(conn, cfg, false)
+}
+
+// Client runs the client side of the handshake on conn and returns the
+// encrypted connection.
+func Client(conn net.Conn, cfg *Config) (*Conn, error) {
+	return handshake(conn, cfg, true)
+}
+
+func handshake(conn net.Conn, cfg *Config, isClient bool) (*Conn, error) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+
+	conn.SetDeadline(time.Now().Add(cfg.handshakeTimeout()))
+	c, err := doHandshake(conn, cfg, isClient)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+func doHandshake(conn net.Conn, cfg *Config, isClient bool) (*Conn, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	hello := append([]byte{version}, priv.PublicKey().Bytes()...)
+
+	var clientHello, serverHello []byte
+	if isClient {
+		if _, err = conn.Write(hello); err != nil {
+			return nil, err
+		}
+		if serverHello, err = readHello(conn); err != nil {
+			return nil, err
+		}
+		clientHello = hello
+	} else {
+		if clientHello, err = readHello(conn); err != nil {
+			return nil, err
+		}
+		if _, err = conn.Write(hello); err != nil {
+			return nil, err
+		}
+		serverHello = hello
+	}
+
+	peerHello := serverHello
+	if !isClient {
+		peerHello = clientHello
+	}
+	peerKey, err := ecdh.X25519().NewPublicKey(peerHello[1:])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrHandshake, err)
+	}
+	shared, err := priv.ECDH(peerKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrHandshake, err)
+	}
+
+	info := make([]byte, 0, len(label)+len(clientHello)+len(serverHello))
+	info = append(info, label...)
+	info = append(info, clientHello...)
+	info = append(info, serverHello...)
+	keys := hkdf(shared, cfg.PSK, info, 2*keySize)
+
+	c2s, err := cfg.newAEAD(keys[:keySize])
+	if err != nil {
+		return nil, err
+	}
+	s2c, err := cfg.newAEAD(keys[keySize:])
+	if err != nil {
+		return nil, err
+	}
+
+	c := newConn(conn, cfg.maxRecordSize())
+	if isClient {
+		c.out.aead, c.in.aead = c2s, s2c
+		if err = expectFinished(c, serverFinished); err != nil {
+			return nil, err
+		}
+		if _, err = c.Write(clientFinished); err != nil {
+			return nil, err
+		}
+	} else {
+		c.out.aead, c.in.aead = s2c, c2s
+		if _, err = c.Write(serverFinished); err != nil {
+			return nil, err
+		}
+		if err = expectFinished(c, clientFinished); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func readHello(r io.Reader) ([]byte, error) {
+	hello := make([]byte, 1+keySize)
+	if _, err := io.ReadFull(r, hello); err != nil {
+		return nil, err
+	}
+	if hello[0] != version {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrHandshake, hello[0])
+	}
+	return hello, nil
+}
+
+func expectFinished(c *Conn, want []byte) error {
+	// small MaxRecordSize values split the message over several records
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(c, got); err != nil {
+		return fmt.Errorf("%w: %v", ErrHandshake, err)
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("%w: unexpected finished message", ErrHandshake)
+	}
+	return nil
+}
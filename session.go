@@ -0,0 +1,234 @@
+package netlib
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// Session is the server side record of an accepted connection.
+type Session struct {
+	id   uint64
+	conn Conn
+	mgr  *SessionManager
+
+	mu         sync.RWMutex
+	key        string
+	data       map[string]any
+	kickReason string
+}
+
+func (s *Session) ID() uint64 {
+	return s.id
+}
+
+func (s *Session) Conn() Conn {
+	return s.conn
+}
+
+// Key returns the user key bound by SessionManager.Bind.
+func (s *Session) Key() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.key
+}
+
+func (s *Session) Set(key string, value any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data == nil {
+		s.data = make(map[string]any)
+	}
+	s.data[key] = value
+}
+
+func (s *Session) Get(key string) (any, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, ok := s.data[key]
+	return value, ok
+}
+
+func (s *Session) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.data, key)
+}
+
+// KickReason returns the reason passed to Kick, if the session was kicked.
+func (s *Session) KickReason() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.kickReason
+}
+
+// Kick closes the connection of the session. WS connections are closed
+// with code 1008 and reason as the text of the close frame.
+func (s *Session) Kick(reason string) {
+	s.mu.Lock()
+	s.kickReason = reason
+	s.mu.Unlock()
+
+	if s.mgr.OnKick != nil {
+		s.mgr.OnKick(s, reason)
+	}
+	if wsConn, ok := s.conn.(*WSConn); ok {
+		wsConn.CloseWithReason(websocket.ClosePolicyViolation, reason)
+		return
+	}
+	s.conn.Close()
+}
+
+// SessionManager tracks the connections accepted by one or more servers.
+type SessionManager struct {
+	mu       sync.RWMutex
+	nextID   atomic.Uint64
+	sessions map[uint64]*Session
+	keys     map[string]*Session
+
+	// OnKick is called before the connection of a kicked session is closed,
+	// e.g. to queue a message carrying the reason.
+	OnKick func(s *Session, reason string)
+}
+
+func NewSessionManager() *SessionManager {
+	return &SessionManager{
+		sessions: make(map[uint64]*Session),
+		keys:     make(map[string]*Session),
+	}
+}
+
+func (m *SessionManager) add(conn Conn) *Session {
+	s := &Session{
+		id:   m.nextID.Add(1),
+		conn: conn,
+		mgr:  m,
+	}
+
+	m.mu.Lock()
+	m.sessions[s.id] = s
+	m.mu.Unlock()
+	return s
+}
+
+func (m *SessionManager) remove(s *Session) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions, s.id)
+	if key := s.Key(); key != "" && m.keys[key] == s {
+		delete(m.keys, key)
+	}
+}
+
+func (m *SessionManager) Get(id uint64) (*Session, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s, ok := m.sessions[id]
+	return s, ok
+}
+
+func (m *SessionManager) GetByKey(key string) (*Session, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s, ok := m.keys[key]
+	return s, ok
+}
+
+// Bind associates a user key with session id. The session previously
+// bound to key, if any, is unbound and returned so the caller can kick it.
+func (m *SessionManager) Bind(id uint64, key string) (*Session, error) {
+	if key == "" {
+		return nil, errors.New("empty session key")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[id]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+
+	prev := m.keys[key]
+	if prev == s {
+		return nil, nil
+	}
+	if prev != nil {
+		prev.mu.Lock()
+		prev.key = ""
+		prev.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	if s.key != "" {
+		delete(m.keys, s.key)
+	}
+	s.key = key
+	s.mu.Unlock()
+
+	m.keys[key] = s
+	return prev, nil
+}
+
+func (m *SessionManager) Unbind(id uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[id]
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	if s.key != "" && m.keys[s.key] == s {
+		delete(m.keys, s.key)
+	}
+	s.key = ""
+	s.mu.Unlock()
+}
+
+func (m *SessionManager) Count() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.sessions)
+}
+
+// Range calls fn for every session until fn returns false. fn runs without
+// the manager lock held, so it may kick or bind sessions.
+func (m *SessionManager) Range(fn func(s *Session) bool) {
+	m.mu.RLock()
+	sessions := make([]*Session, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		sessions = append(sessions, s)
+	}
+	m.mu.RUnlock()
+
+	for _, s := range sessions {
+		if !fn(s) {
+			return
+		}
+	}
+}
+
+func (m *SessionManager) Kick(id uint64, reason string) error {
+	s, ok := m.Get(id)
+	if !ok {
+		return ErrSessionNotFound
+	}
+	s.Kick(reason)
+	return nil
+}
+
+func (m *SessionManager) KickByKey(key string, reason string) error {
+	s, ok := m.GetByKey(key)
+	if !ok {
+		return ErrSessionNotFound
+	}
+	s.Kick(reason)
+	return nil
+}
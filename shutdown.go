@@ -0,0 +1,22 @@
+package netlib
+
+import (
+	"context"
+	"sync"
+)
+
+// waitContext waits for wg, giving up when ctx is done.
+func waitContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
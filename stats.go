@@ -0,0 +1,41 @@
+package netlib
+
+import (
+	"sync/atomic"
+
+	"github.com/gzjjyz/netlib/metrics"
+)
+
+// ConnStats is a snapshot of the traffic counters of one connection. The
+// heartbeats it sends are not counted in BytesOut and MsgsOut.
+type ConnStats struct {
+	BytesIn    uint64
+	BytesOut   uint64
+	MsgsIn     uint64
+	MsgsOut    uint64
+	QueueDepth int
+}
+
+type connStats struct {
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+	msgsIn   atomic.Uint64
+	msgsOut  atomic.Uint64
+}
+
+func (s *connStats) snapshot(queueDepth int) ConnStats {
+	return ConnStats{
+		BytesIn:    s.bytesIn.Load(),
+		BytesOut:   s.bytesOut.Load(),
+		MsgsIn:     s.msgsIn.Load(),
+		MsgsOut:    s.msgsOut.Load(),
+		QueueDepth: queueDepth,
+	}
+}
+
+func metricsOrNop(m metrics.Metrics) metrics.Metrics {
+	if m == nil {
+		return metrics.Nop{}
+	}
+	return m
+}
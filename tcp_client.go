@@ -1,9 +1,11 @@
 package netlib
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/gzjjyz/netlib/log"
+	"github.com/gzjjyz/netlib/metrics"
 	"github.com/gzjjyz/netlib/parser"
 	"net"
 	"sync"
@@ -51,86 +53,234 @@ func NewTCPClient(
 
 type TCPClient struct {
 	sync.Mutex
+	// Network is "tcp", "tcp4", "tcp6" or "unix", "tcp" when empty.
+	Network         string
 	Addr            string
 	ConnectInterval time.Duration
 	WriteChanCap    int
 	AutoReconnect   bool
 	NewAgent        func(*TCPConn) Agent
-	wg              sync.WaitGroup
-	closeFlag       atomic.Bool
+	KeepAlive       KeepAliveOptions
+	Backpressure    BackpressureOptions
+	Metrics         metrics.Metrics
+	ReadBufferSize  int
+	WriteBatchDelay time.Duration
+	// Backoff spaces reconnection attempts.
+	Backoff BackoffOptions
+	// OnStateChange is called on every state change, with the reason for
+	// StateDisconnected and StateGaveUp.
+	OnStateChange func(state ClientState, err error)
+	wg            sync.WaitGroup
+	closeFlag     atomic.Bool
+	state         atomic.Int32
+	stop          chan struct{}
+
+	// TLSConfig enables TLS. Set Certificates to present a client
+	// certificate for mutual TLS.
+	TLSConfig *tls.Config
+	// HandshakeTimeout bounds dialing and the TLS handshake, 10 seconds when zero.
+	HandshakeTimeout time.Duration
+	// Handshake runs after dialing and before NewAgent, see TCPServer.Handshake.
+	Handshake func(conn net.Conn) (net.Conn, error)
 
 	conn net.Conn
 	// msg parser
 	msgParser *parser.Parser
+	// dialFunc replaces the TCP dialer, e.g. for UDPClient
+	dialFunc func(timeout time.Duration) (net.Conn, error)
+}
+
+func (client *TCPClient) connConfig() *connConfig {
+	return &connConfig{
+		writeChanCap: client.WriteChanCap,
+		keepAlive:    client.KeepAlive,
+		backpressure: client.Backpressure,
+		metrics:      client.Metrics,
+		readBufSize:  client.ReadBufferSize,
+		writeDelay:   client.WriteBatchDelay,
+	}
 }
 
-func (client *TCPClient) Start() {
+func (client *TCPClient) network() string {
+	if client.Network == "" {
+		return "tcp"
+	}
+	return client.Network
+}
+
+func (client *TCPClient) Start() error {
+	if client.KeepAlive.HeartbeatInterval > 0 && !client.msgParser.Heartbeat() {
+		return errors.New("heartbeat requires parser option Heartbeat")
+	}
+
+	client.Lock()
+	client.stop = make(chan struct{})
+	client.Unlock()
+
 	client.wg.Add(1)
 	go client.connect()
+	return nil
+}
+
+// State returns the current connection state.
+func (client *TCPClient) State() ClientState {
+	return ClientState(client.state.Load())
+}
+
+func (client *TCPClient) setState(state ClientState, err error) {
+	client.state.Store(int32(state))
+	if client.OnStateChange != nil {
+		client.OnStateChange(state, err)
+	}
 }
 
-func (client *TCPClient) dial() (net.Conn, error) {
+func (client *TCPClient) dial(failures *int) (net.Conn, error) {
 	for {
-		conn, err := net.Dial("tcp", client.Addr)
+		client.setState(StateConnecting, nil)
+		conn, err := client.dialOnce()
 
 		if client.closeFlag.Load() {
+			if conn != nil {
+				conn.Close()
+			}
 			return nil, errors.New("client closed")
 		}
 
-		if err != nil {
-			log.Error("connect to %v error: %v", client.Addr, err)
-			if !client.AutoReconnect {
-				return nil, err
-			}
-			time.Sleep(client.ConnectInterval)
+		if err == nil {
+			return conn, nil
+		}
 
-			continue
+		log.Error("connect to %v error: %v", client.Addr, err)
+		if !client.retry(failures, err) {
+			return nil, err
 		}
+	}
+}
 
-		return conn, nil
+// retry counts a failed attempt and waits before the next one. It reports
+// false when the client gives up or is stopped.
+func (client *TCPClient) retry(failures *int, err error) bool {
+	*failures++
+	if !client.AutoReconnect || client.Backoff.exhausted(*failures) {
+		client.setState(StateGaveUp, err)
+		return false
 	}
+	client.setState(StateDisconnected, err)
+	return sleep(client.Backoff.delay(*failures-1, client.ConnectInterval), client.stop)
 }
 
-func (client *TCPClient) connect() {
-	defer client.wg.Done()
+func (client *TCPClient) dialOnce() (net.Conn, error) {
+	timeout := client.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = defaultHandshakeTimeout
+	}
+	dialer := &net.Dialer{Timeout: timeout}
 
-reconnect:
-	conn, err := client.dial()
-	if err != nil || conn == nil {
-		return
+	var conn net.Conn
+	var err error
+	if client.dialFunc != nil {
+		conn, err = client.dialFunc(timeout)
+		if err == nil && client.TLSConfig != nil {
+			tc := tls.Client(conn, client.TLSConfig)
+			if err = tlsHandshake(tc, timeout); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			conn = tc
+		}
+	} else if client.TLSConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, client.network(), client.Addr, client.TLSConfig)
+	} else {
+		conn, err = dialer.Dial(client.network(), client.Addr)
+	}
+	if err != nil || client.Handshake == nil {
+		return conn, err
 	}
 
-	if client.closeFlag.Load() {
+	wrapped, err := client.Handshake(conn)
+	if err != nil {
 		conn.Close()
-		return
+		return nil, err
 	}
+	return wrapped, nil
+}
+
+func (client *TCPClient) connect() {
+	defer client.wg.Done()
+
+	failures := 0
+	for {
+		conn, err := client.dial(&failures)
+		if err != nil {
+			return
+		}
+
+		client.Lock()
+		if client.closeFlag.Load() {
+			client.Unlock()
+			conn.Close()
+			return
+		}
+		client.conn = conn
+		client.Unlock()
 
-	client.conn = conn
+		tcpConn := newTCPConn(conn, client.msgParser, client.connConfig())
+		agent := client.NewAgent(tcpConn)
+		if agent == nil {
+			tcpConn.Close()
+			client.setState(StateDisconnected, ErrConnClosed)
+			return
+		}
+		client.setState(StateConnected, nil)
+		connected := time.Now()
+		agent.Run()
 
-	tcpConn := newTCPConn(conn, client.WriteChanCap, client.msgParser)
-	agent := client.NewAgent(tcpConn)
-	if agent == nil {
+		// cleanup
 		tcpConn.Close()
-		return
-	}
-	agent.Run()
+		agent.OnClose()
 
-	// cleanup
-	tcpConn.Close()
-	agent.OnClose()
+		client.Lock()
+		client.conn = nil
+		client.Unlock()
+		if client.closeFlag.Load() {
+			return
+		}
 
-	if client.AutoReconnect {
-		time.Sleep(client.ConnectInterval)
-		goto reconnect
+		reason := tcpConn.cause.get()
+		if reason == nil {
+			reason = ErrConnClosed
+		}
+		if !client.AutoReconnect {
+			client.setState(StateDisconnected, reason)
+			return
+		}
+		if client.Backoff.stable(time.Since(connected)) {
+			failures = 0
+		}
+		if !client.retry(&failures, reason) {
+			return
+		}
 	}
 }
 
+// Stop closes the connection, interrupts a pending reconnection and waits
+// for the agent to return.
 func (client *TCPClient) Stop() {
+	client.Lock()
 	if client.closeFlag.Load() {
+		client.Unlock()
 		return
 	}
 	client.closeFlag.Store(true)
-	client.conn.Close()
+	if client.stop != nil {
+		close(client.stop)
+	}
+	conn := client.conn
+	client.Unlock()
 
+	if conn != nil {
+		conn.Close()
+	}
 	client.wg.Wait()
+	client.setState(StateStopped, nil)
 }
@@ -1,78 +1,255 @@
 package netlib
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/gzjjyz/netlib/metrics"
 	"github.com/gzjjyz/netlib/parser"
 	"net"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/gzjjyz/netlib/log"
 )
 
 type ConnSet map[net.Conn]struct{}
 
+// connConfig carries the per-connection settings of a server or client.
+type connConfig struct {
+	writeChanCap int
+	keepAlive    KeepAliveOptions
+	backpressure BackpressureOptions
+	metrics      metrics.Metrics
+	rateLimit    *RateLimitOptions
+	readBufSize  int
+	writeDelay   time.Duration
+	// messageType is the default type of WS messages
+	messageType MessageType
+	// closeTimeout bounds the WS closing handshake
+	closeTimeout time.Duration
+}
+
+const (
+	defaultReadBufSize = 4096
+	// maxWriteBatch bounds the bytes the writer goroutine coalesces into one write
+	maxWriteBatch = 64 * 1024
+)
+
 type TCPConn struct {
+	sync.Mutex
 	conn      net.Conn
-	writeChan chan []byte
+	writeChan *writeQueue
 	closeFlag atomic.Bool
 	parser    *parser.Parser
+	keepAlive KeepAliveOptions
+	lastWrite atomic.Int64
+	deadOnce  sync.Once
+	done      chan struct{}
+	metrics   metrics.Metrics
+	stats     connStats
+	session   *Session
+	limiter   *connLimiter
+	cause     closeCause
+	reader    *bufio.Reader
+	// writeDelay is how long the writer goroutine waits for more messages
+	// before writing a batch
+	writeDelay time.Duration
 }
 
-func newTCPConn(conn net.Conn, writeChanCap int, msgParser *parser.Parser) *TCPConn {
+func newTCPConn(conn net.Conn, msgParser *parser.Parser, cfg *connConfig) *TCPConn {
 	tcpConn := new(TCPConn)
 	tcpConn.conn = conn
-	tcpConn.writeChan = make(chan []byte, writeChanCap)
+	tcpConn.metrics = metricsOrNop(cfg.metrics)
+	tcpConn.writeChan = newWriteQueue(cfg.writeChanCap, cfg.backpressure, tcpConn.metrics)
+	if cfg.rateLimit != nil {
+		tcpConn.limiter = newConnLimiter(cfg.rateLimit, tcpConn.metrics)
+	}
+	readBufSize := cfg.readBufSize
+	if readBufSize <= 0 {
+		readBufSize = defaultReadBufSize
+	}
+	tcpConn.reader = bufio.NewReaderSize(socketReader{tcpConn}, readBufSize)
 	tcpConn.parser = msgParser
+	if msgParser.Heartbeat() {
+		tcpConn.writeChan.heartbeat = msgParser.PackHeartbeat()
+	}
+	tcpConn.keepAlive = cfg.keepAlive
+	tcpConn.writeDelay = cfg.writeDelay
+	tcpConn.lastWrite.Store(time.Now().UnixNano())
+	tcpConn.done = make(chan struct{})
 
 	go func() {
-		for b := range tcpConn.writeChan {
-			if b == nil {
+		var vec [][]byte
+		var merged []byte
+		for f := range tcpConn.writeChan.ch {
+			tcpConn.writeChan.dequeued(f)
+			if f == nil {
 				break
 			}
 
-			_, err := conn.Write(b)
+			// coalesce everything queued meanwhile into a single write
+			var msgs, beats int
+			var stop bool
+			vec, msgs, beats, stop = tcpConn.writeChan.batch(vec[:0], f, maxWriteBatch, tcpConn.writeDelay)
+
+			if tcpConn.keepAlive.WriteIdleTimeout > 0 {
+				conn.SetWriteDeadline(time.Now().Add(tcpConn.keepAlive.WriteIdleTimeout))
+			}
+			n, err := writeVec(conn, vec, &merged)
+			for i := range vec {
+				vec[i] = nil
+			}
+			// heartbeats are not counted in the stats
+			if n -= int64(beats * len(tcpConn.writeChan.heartbeat)); n < 0 {
+				n = 0
+			}
+			tcpConn.stats.bytesOut.Add(uint64(n))
+			tcpConn.metrics.BytesOut(int(n))
 			if err != nil {
+				tcpConn.cause.set(err)
+				if isTimeout(err) {
+					tcpConn.dead(err)
+				}
+				break
+			}
+			tcpConn.stats.msgsOut.Add(uint64(msgs))
+			for i := 0; i < msgs; i++ {
+				tcpConn.metrics.MsgOut()
+			}
+			tcpConn.lastWrite.Store(time.Now().UnixNano())
+			if stop {
 				break
 			}
 		}
 
 		conn.Close()
+		// wake writers waiting for queue room
+		close(tcpConn.done)
+		tcpConn.Lock()
 		tcpConn.closeFlag.Store(true)
+		tcpConn.writeChan.drain()
+		tcpConn.Unlock()
 	}()
 
+	if tcpConn.keepAlive.HeartbeatInterval > 0 && msgParser.Heartbeat() {
+		go idleTimer(tcpConn.keepAlive.HeartbeatInterval, tcpConn.lastWriteTime, tcpConn.ping, tcpConn.done)
+	}
+
 	return tcpConn
 }
 
+// writeVec writes vec with writev on plain sockets. Other conns, such as
+// TLS, get the parts merged into one write so they are not split into
+// several records.
+func writeVec(conn net.Conn, vec [][]byte, merged *[]byte) (int64, error) {
+	switch conn.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		bufs := net.Buffers(vec)
+		return bufs.WriteTo(conn)
+	}
+
+	if len(vec) == 1 {
+		n, err := conn.Write(vec[0])
+		return int64(n), err
+	}
+	b := (*merged)[:0]
+	for _, part := range vec {
+		b = append(b, part...)
+	}
+	if cap(b) <= maxWriteBatch*2 {
+		*merged = b
+	}
+	n, err := conn.Write(b)
+	return int64(n), err
+}
+
+func (tcpConn *TCPConn) lastWriteTime() time.Time {
+	return time.Unix(0, tcpConn.lastWrite.Load())
+}
+
+func (tcpConn *TCPConn) ping() {
+	tcpConn.doWrite(frame{tcpConn.writeChan.heartbeat})
+}
+
+func (tcpConn *TCPConn) dead(err error) {
+	tcpConn.deadOnce.Do(func() {
+		log.Debug("peer %v dead: %v", tcpConn.RemoteAddr(), err)
+		if tcpConn.keepAlive.OnDead != nil {
+			tcpConn.keepAlive.OnDead(tcpConn, err)
+		}
+	})
+}
+
+func (tcpConn *TCPConn) closed() bool {
+	return tcpConn.closeFlag.Load()
+}
+
 func (tcpConn *TCPConn) doDestroy() {
-	tcpConn.conn.(*net.TCPConn).SetLinger(0)
+	setNoLinger(tcpConn.conn)
 	tcpConn.conn.Close()
 
 	if !tcpConn.closeFlag.Load() {
-		close(tcpConn.writeChan)
+		tcpConn.writeChan.close()
 		tcpConn.closeFlag.Store(true)
 	}
 }
 
 func (tcpConn *TCPConn) Destroy() {
+	tcpConn.Lock()
+	defer tcpConn.Unlock()
+
 	tcpConn.doDestroy()
 }
 
+// Close closes the connection once the queued messages are written.
 func (tcpConn *TCPConn) Close() {
+	tcpConn.Lock()
+	defer tcpConn.Unlock()
 	if tcpConn.closeFlag.Load() {
 		return
 	}
 
-	tcpConn.doWrite(nil)
+	if !tcpConn.writeChan.tryPush(nil) {
+		log.Debug("close conn: channel full")
+		tcpConn.doDestroy()
+		return
+	}
 	tcpConn.closeFlag.Store(true)
 }
 
-func (tcpConn *TCPConn) doWrite(b []byte) {
-	if len(tcpConn.writeChan) == cap(tcpConn.writeChan) {
-		log.Debug("close conn: channel full")
-		tcpConn.doDestroy()
+// shutdown is Close waiting for queue room until ctx is done, when the
+// connection is destroyed instead.
+func (tcpConn *TCPConn) shutdown(ctx context.Context) {
+	tcpConn.Lock()
+	defer tcpConn.Unlock()
+	if tcpConn.closeFlag.Load() {
 		return
 	}
 
-	tcpConn.writeChan <- b
+	err := tcpConn.writeChan.waitRoom(0, tcpConn, tcpConn.done, ctx.Done(), nil)
+	if err != nil {
+		if err == ErrQueueFull {
+			log.Debug("close conn: %v", ctx.Err())
+			tcpConn.doDestroy()
+		}
+		return
+	}
+	tcpConn.writeChan.tryPush(nil)
+	tcpConn.closeFlag.Store(true)
+}
+
+func (tcpConn *TCPConn) doWrite(f frame) error {
+	tcpConn.Lock()
+	defer tcpConn.Unlock()
+	if tcpConn.closeFlag.Load() {
+		return ErrConnClosed
+	}
+
+	return tcpConn.writeChan.push(f, tcpConn, tcpConn.done)
 }
 
 // b must not be modified by the others goroutines
@@ -81,15 +258,24 @@ func (tcpConn *TCPConn) Write(b []byte) {
 		return
 	}
 
-	if tcpConn.closeFlag.Load() {
-		return
-	}
-
-	tcpConn.doWrite(b)
+	tcpConn.doWrite(frame{b})
 }
 
+// Read reads buffered data. It shares the buffer with ReadMsg, do not mix them.
 func (tcpConn *TCPConn) Read(b []byte) (int, error) {
-	return tcpConn.conn.Read(b)
+	return tcpConn.reader.Read(b)
+}
+
+// socketReader feeds the read buffer and counts the bytes received.
+type socketReader struct {
+	tcpConn *TCPConn
+}
+
+func (r socketReader) Read(b []byte) (int, error) {
+	n, err := r.tcpConn.conn.Read(b)
+	r.tcpConn.stats.bytesIn.Add(uint64(n))
+	r.tcpConn.metrics.BytesIn(n)
+	return n, err
 }
 
 func (tcpConn *TCPConn) LocalAddr() net.Addr {
@@ -100,15 +286,112 @@ func (tcpConn *TCPConn) RemoteAddr() net.Addr {
 	return tcpConn.conn.RemoteAddr()
 }
 
+// ID returns the session ID of a server connection, 0 for client connections.
+func (tcpConn *TCPConn) ID() uint64 {
+	if tcpConn.session == nil {
+		return 0
+	}
+	return tcpConn.session.ID()
+}
+
+// Session returns the session of a server connection, nil for client connections.
+func (tcpConn *TCPConn) Session() *Session {
+	return tcpConn.session
+}
+
+// ConnectionState returns the TLS state of the connection, nil when it is
+// not TLS.
+func (tcpConn *TCPConn) ConnectionState() *tls.ConnectionState {
+	tc := unwrapTLS(tcpConn.conn)
+	if tc == nil {
+		return nil
+	}
+	state := tc.ConnectionState()
+	return &state
+}
+
+// PeerCertificate returns the leaf certificate of the peer once it has been
+// verified against the TLS configuration, e.g. with
+// tls.RequireAndVerifyClientCert on the server. It is nil otherwise.
+func (tcpConn *TCPConn) PeerCertificate() *x509.Certificate {
+	return peerCertificate(tcpConn.ConnectionState())
+}
+
+func (tcpConn *TCPConn) Stats() ConnStats {
+	return tcpConn.stats.snapshot(tcpConn.writeChan.len())
+}
+
+// ReadMsg returns the next message. Heartbeat frames are consumed here and
+// answered when this side does not send its own. Messages over the rate
+// limits are dropped or delayed, or ErrRateLimited is returned, according
+// to the policy.
 func (tcpConn *TCPConn) ReadMsg() ([]byte, error) {
-	return tcpConn.parser.Read(tcpConn)
+	return tcpConn.ReadMsgInto(nil)
+}
+
+// ReadMsgInto is ReadMsg reading into buf when it is large enough, see
+// parser.ReadInto. Pair it with bufpool to reuse buffers on hot paths.
+func (tcpConn *TCPConn) ReadMsgInto(buf []byte) ([]byte, error) {
+	for {
+		if tcpConn.keepAlive.ReadIdleTimeout > 0 {
+			tcpConn.conn.SetReadDeadline(time.Now().Add(tcpConn.keepAlive.ReadIdleTimeout))
+		}
+
+		msg, err := tcpConn.parser.ReadInto(tcpConn.reader, buf)
+		if err != nil {
+			tcpConn.cause.set(err)
+			if isTimeout(err) {
+				tcpConn.dead(err)
+			} else if errors.Is(err, parser.ErrMsgTooLong) || errors.Is(err, parser.ErrMsgTooShort) {
+				tcpConn.metrics.ParseError()
+			}
+			return nil, err
+		}
+
+		if len(msg) == 0 && tcpConn.parser.Heartbeat() {
+			if tcpConn.keepAlive.HeartbeatInterval <= 0 {
+				tcpConn.ping()
+			}
+			continue
+		}
+
+		if tcpConn.limiter != nil {
+			drop, err := tcpConn.limiter.check(tcpConn.RemoteAddr(), len(msg))
+			if err != nil {
+				tcpConn.cause.set(err)
+				return nil, err
+			}
+			if drop {
+				continue
+			}
+		}
+
+		tcpConn.stats.msgsIn.Add(1)
+		tcpConn.metrics.MsgIn()
+		return msg, nil
+	}
+}
+
+func (tcpConn *TCPConn) frameKey() any {
+	return tcpConn.parser
+}
+
+func (tcpConn *TCPConn) packFrame(args ...[]byte) (frame, error) {
+	return tcpConn.parser.PackParts(args...)
+}
+
+func (tcpConn *TCPConn) writeFrame(f frame) error {
+	return tcpConn.doWrite(f)
 }
 
+// WriteMsg queues a message for writing. The args are queued as they are,
+// not copied, so they must not be modified by the others goroutines. It
+// returns ErrConnClosed once the connection is closed and ErrQueueFull when
+// the backpressure policy rejects the message.
 func (tcpConn *TCPConn) WriteMsg(args ...[]byte) error {
-	buf, err := tcpConn.parser.PackMsg(args...)
+	f, err := tcpConn.parser.PackParts(args...)
 	if err != nil {
 		return err
 	}
-	tcpConn.Write(buf)
-	return nil
+	return tcpConn.doWrite(f)
 }
@@ -1,13 +1,17 @@
 package netlib
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
+	"os"
 	"sync"
 	"time"
 
 	"github.com/gzjjyz/netlib/log"
+	"github.com/gzjjyz/netlib/metrics"
 	"github.com/gzjjyz/netlib/parser"
 )
 
@@ -41,35 +45,129 @@ func NewTCPServer(
 		MaxConnNum:   maxConnNum,
 		WriteChanCap: writeChanCap,
 		NewAgent:     newAgentHandler,
-		conns:        make(ConnSet),
+		conns:        make(map[net.Conn]*TCPConn),
+		handshaking:  make(map[net.Conn]struct{}),
+		Sessions:     NewSessionManager(),
 		msgParser:    p,
 	}
 	return server, nil
 }
 
 type TCPServer struct {
+	// Network is "tcp", "tcp4", "tcp6" or "unix", "tcp" when empty.
+	Network      string
 	Addr         string
 	MaxConnNum   int
 	WriteChanCap int
 	NewAgent     func(*TCPConn) Agent
 	ln           net.Listener
-	conns        ConnSet
-	mutexConns   sync.Mutex
-	wgLn         sync.WaitGroup
-	wgConns      sync.WaitGroup
+	conns        map[net.Conn]*TCPConn
+	// handshaking holds the accepted sockets still in a handshake, they
+	// count against MaxConnNum
+	handshaking map[net.Conn]struct{}
+	mutexConns  sync.Mutex
+	wgLn        sync.WaitGroup
+	wgConns     sync.WaitGroup
+	closed      bool
+
+	// SocketMode sets the permissions of the socket file of a unix
+	// server, e.g. 0660, when it is not zero. The socket file only appears
+	// once it has them.
+	SocketMode os.FileMode
+	// TLSConfig enables TLS on accepted connections. Set ClientAuth to
+	// tls.RequireAndVerifyClientCert and ClientCAs for mutual TLS.
+	TLSConfig *tls.Config
+	// HandshakeTimeout bounds the TLS handshake, 10 seconds when zero.
+	HandshakeTimeout time.Duration
+	// Handshake runs after the TLS handshake and before NewAgent. The
+	// returned conn replaces the accepted one, e.g. to layer an encrypted
+	// channel from the secure package between the socket and the parser.
+	Handshake func(conn net.Conn) (net.Conn, error)
+	// Sessions registers every accepted connection. It may be shared with
+	// other servers so one manager covers TCP and WS connections.
+	Sessions *SessionManager
+	// KeepAlive configures idle timeouts and heartbeats of accepted connections.
+	KeepAlive KeepAliveOptions
+	// Backpressure decides what happens to writes when a write queue is full.
+	Backpressure BackpressureOptions
+	// Metrics receives server and connection events, nil disables them.
+	Metrics metrics.Metrics
+	// ReadBufferSize sizes the read buffer of each connection, 4096 when zero.
+	ReadBufferSize int
+	// WriteBatchDelay lets the writer of each connection wait that long for
+	// more messages before writing, trading latency for fewer syscalls.
+	// Zero writes as soon as a message is queued.
+	WriteBatchDelay time.Duration
+	// RateLimit limits inbound messages per connection and new connections
+	// per source IP.
+	RateLimit RateLimitOptions
+	// Admit runs right after accept, before any handshake, e.g. the Admit
+	// method of an AdmissionFilter. When TLSConfig or Handshake is set, a
+	// rejection with a final message runs the handshake, bounded by a few
+	// seconds, to send it; one without is closed right away.
+	Admit AdmitFunc
+	// FullMessage is sent as a final frame to connections rejected because
+	// of MaxConnNum, nil closes them silently. Connections count against
+	// MaxConnNum from accept, so the check runs before any handshake, like
+	// Admit.
+	FullMessage []byte
+	// OnShutdown is called for every live connection when Shutdown starts,
+	// e.g. to queue a "going away" message before the connection is closed.
+	OnShutdown func(*TCPConn)
 
 	// msg parser
 	msgParser *parser.Parser
+	ipLimiter *ipLimiter
+	// listen replaces the TCP listener, e.g. for UDPServer
+	listen func() (net.Listener, error)
+}
+
+func (server *TCPServer) connConfig() *connConfig {
+	return &connConfig{
+		writeChanCap: server.WriteChanCap,
+		keepAlive:    server.KeepAlive,
+		backpressure: server.Backpressure,
+		metrics:      server.Metrics,
+		readBufSize:  server.ReadBufferSize,
+		writeDelay:   server.WriteBatchDelay,
+		rateLimit:    &server.RateLimit,
+	}
+}
+
+func (server *TCPServer) network() string {
+	if server.Network == "" {
+		return "tcp"
+	}
+	return server.Network
 }
 
 func (server *TCPServer) Start() error {
-	ln, err := net.Listen("tcp", server.Addr)
+	if server.KeepAlive.HeartbeatInterval > 0 && !server.msgParser.Heartbeat() {
+		return errors.New("heartbeat requires parser option Heartbeat")
+	}
+
+	server.ipLimiter = newIPLimiter(&server.RateLimit, metricsOrNop(server.Metrics))
+
+	var ln net.Listener
+	var err error
+	switch {
+	case server.listen != nil:
+		ln, err = server.listen()
+	case server.Network == "unix":
+		ln, err = listenUnix(server.Addr, server.SocketMode)
+	default:
+		ln, err = net.Listen(server.network(), server.Addr)
+	}
 	if err != nil {
 		return err
 	}
 
+	if server.TLSConfig != nil {
+		ln = tls.NewListener(ln, server.TLSConfig)
+	}
 	server.ln = ln
 
+	server.wgLn.Add(1)
 	go server.run()
 
 	return nil
@@ -80,16 +178,56 @@ func (server *TCPServer) Stop() {
 	server.wgLn.Wait()
 
 	server.mutexConns.Lock()
+	server.closed = true
 	for conn := range server.conns {
 		conn.Close()
 	}
-	server.conns = nil
+	for conn := range server.handshaking {
+		conn.Close()
+	}
 	server.mutexConns.Unlock()
 	server.wgConns.Wait()
 }
 
+// Shutdown stops accepting new connections and closes the live ones after
+// their queued writes are flushed. Connections still open when ctx is done
+// are destroyed and ctx.Err() is returned.
+func (server *TCPServer) Shutdown(ctx context.Context) error {
+	server.ln.Close()
+	server.wgLn.Wait()
+
+	server.mutexConns.Lock()
+	server.closed = true
+	conns := make([]*TCPConn, 0, len(server.conns))
+	for _, tcpConn := range server.conns {
+		conns = append(conns, tcpConn)
+	}
+	server.mutexConns.Unlock()
+
+	for _, tcpConn := range conns {
+		if server.OnShutdown != nil {
+			server.OnShutdown(tcpConn)
+		}
+		// a full queue must not hold up the other connections
+		go tcpConn.shutdown(ctx)
+	}
+
+	err := waitContext(ctx, &server.wgConns)
+	if err != nil {
+		server.mutexConns.Lock()
+		for _, tcpConn := range server.conns {
+			tcpConn.Destroy()
+		}
+		for conn := range server.handshaking {
+			conn.Close()
+		}
+		server.mutexConns.Unlock()
+		server.wgConns.Wait()
+	}
+	return err
+}
+
 func (server *TCPServer) run() {
-	server.wgLn.Add(1)
 	defer server.wgLn.Done()
 
 	var tempDelay time.Duration
@@ -112,39 +250,112 @@ func (server *TCPServer) run() {
 			return
 		}
 		tempDelay = 0
+		metricsOrNop(server.Metrics).ConnAccepted()
 
-		server.mutexConns.Lock()
-		if len(server.conns) >= server.MaxConnNum {
-			server.mutexConns.Unlock()
+		server.wgConns.Add(1)
+		go server.serve(conn)
+	}
+}
+
+// handshake runs the TLS handshake, then the Handshake hook, on conn.
+func (server *TCPServer) handshake(conn net.Conn) (net.Conn, error) {
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := tlsHandshake(tc, server.HandshakeTimeout); err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+	}
+	if server.Handshake != nil {
+		return server.Handshake(conn)
+	}
+	return conn, nil
+}
+
+func (server *TCPServer) serve(conn net.Conn) {
+	defer server.wgConns.Done()
+	m := metricsOrNop(server.Metrics)
+
+	if server.Admit != nil {
+		meta := &AdmitMeta{Network: server.network()}
+		if err := server.Admit(conn.RemoteAddr(), meta); err != nil {
+			server.rejectEarly(conn, err)
+			return
+		}
+	}
+
+	if server.ipLimiter != nil {
+		addr := conn.RemoteAddr()
+		if err := server.ipLimiter.acquire(addr); err != nil {
 			conn.Close()
-			log.Debug("too many connections")
-			continue
+			log.Debug("connection from %v: %v", addr, err)
+			return
 		}
+		defer server.ipLimiter.release(addr)
+	}
+
+	// take a slot before any handshake so that slow handshakes are capped
+	// by MaxConnNum too
+	raw := conn
+	server.mutexConns.Lock()
+	if server.closed {
+		server.mutexConns.Unlock()
+		conn.Close()
+		return
+	}
+	if len(server.conns)+len(server.handshaking) >= server.MaxConnNum {
+		server.mutexConns.Unlock()
+		server.rejectEarly(conn, Reject(ErrServerFull, server.FullMessage))
+		return
+	}
+	server.handshaking[raw] = struct{}{}
+	server.mutexConns.Unlock()
 
-		tcpConn := newTCPConn(conn, server.WriteChanCap, server.msgParser)
-		agent := server.NewAgent(tcpConn)
-		if nil == agent {
+	registered := false
+	defer func() {
+		if !registered {
+			server.mutexConns.Lock()
+			delete(server.handshaking, raw)
 			server.mutexConns.Unlock()
-			tcpConn.Close()
-			continue
 		}
+	}()
+
+	conn, err := server.handshake(conn)
+	if err != nil {
+		raw.Close()
+		log.Debug("handshake with %v error: %v", raw.RemoteAddr(), err)
+		return
+	}
 
-		server.conns[conn] = struct{}{}
+	server.mutexConns.Lock()
+	delete(server.handshaking, raw)
+	registered = true
+	if server.closed {
 		server.mutexConns.Unlock()
+		conn.Close()
+		return
+	}
 
-		server.wgConns.Add(1)
+	tcpConn := newTCPConn(conn, server.msgParser, server.connConfig())
+	tcpConn.session = server.Sessions.add(tcpConn)
+	agent := server.NewAgent(tcpConn)
+	if nil == agent {
+		server.mutexConns.Unlock()
+		server.Sessions.remove(tcpConn.session)
+		tcpConn.Close()
+		return
+	}
 
-		go func() {
-			agent.Run()
+	server.conns[conn] = tcpConn
+	server.mutexConns.Unlock()
+	m.ConnOpened()
 
-			// cleanup
-			tcpConn.Close()
-			server.mutexConns.Lock()
-			delete(server.conns, conn)
-			server.mutexConns.Unlock()
-			agent.OnClose()
+	agent.Run()
 
-			server.wgConns.Done()
-		}()
-	}
+	// cleanup
+	tcpConn.Close()
+	server.mutexConns.Lock()
+	delete(server.conns, conn)
+	server.mutexConns.Unlock()
+	server.Sessions.remove(tcpConn.session)
+	m.ConnClosed()
+	agent.OnClose()
 }
@@ -0,0 +1,65 @@
+package netlib
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"time"
+)
+
+const defaultHandshakeTimeout = 10 * time.Second
+
+// netConnWrapper is implemented by connections layered over another
+// net.Conn, such as *tls.Conn.
+type netConnWrapper interface {
+	NetConn() net.Conn
+}
+
+// unwrapTLS returns the *tls.Conn conn is or wraps, if any.
+func unwrapTLS(conn net.Conn) *tls.Conn {
+	for conn != nil {
+		if tc, ok := conn.(*tls.Conn); ok {
+			return tc
+		}
+		w, ok := conn.(netConnWrapper)
+		if !ok {
+			return nil
+		}
+		conn = w.NetConn()
+	}
+	return nil
+}
+
+// setNoLinger makes Close reset the underlying TCP connection, if there is
+// one, so that no queued data lingers after a destroy.
+func setNoLinger(conn net.Conn) {
+	for conn != nil {
+		if tc, ok := conn.(*net.TCPConn); ok {
+			tc.SetLinger(0)
+			return
+		}
+		w, ok := conn.(netConnWrapper)
+		if !ok {
+			return
+		}
+		conn = w.NetConn()
+	}
+}
+
+func tlsHandshake(conn *tls.Conn, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = defaultHandshakeTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return conn.HandshakeContext(ctx)
+}
+
+// peerCertificate returns the verified leaf certificate of the peer.
+func peerCertificate(state *tls.ConnectionState) *x509.Certificate {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
@@ -0,0 +1,57 @@
+package netlib
+
+import (
+	"net"
+	"time"
+
+	"github.com/gzjjyz/netlib/parser"
+	"github.com/gzjjyz/netlib/rudp"
+)
+
+// UDPClient is a TCPClient over reliable UDP, see UDPServer.
+type UDPClient struct {
+	*TCPClient
+	// Config tunes the reliable UDP layer.
+	Config rudp.Config
+	// WrapPacketConn wraps the UDP socket of every connection attempt, e.g.
+	// with rudp.NewLossyPacketConn to simulate packet loss.
+	WrapPacketConn func(net.PacketConn) net.PacketConn
+}
+
+func NewUDPClient(
+	host string,
+	writeChanCap int,
+	interval time.Duration,
+	newAgentHandler func(*TCPConn) Agent,
+	opts *parser.Option,
+) (*UDPClient, error) {
+	tcpClient, err := NewTCPClient(host, writeChanCap, interval, newAgentHandler, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &UDPClient{TCPClient: tcpClient}
+	tcpClient.Network = "udp"
+	tcpClient.dialFunc = client.dialUDP
+	return client, nil
+}
+
+func (client *UDPClient) dialUDP(timeout time.Duration) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", client.Addr)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return nil, err
+	}
+	if client.WrapPacketConn != nil {
+		pc = client.WrapPacketConn(pc)
+	}
+
+	cfg := client.Config
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = timeout
+	}
+	return rudp.DialPacketConn(pc, raddr, &cfg)
+}
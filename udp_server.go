@@ -0,0 +1,49 @@
+package netlib
+
+import (
+	"net"
+
+	"github.com/gzjjyz/netlib/parser"
+	"github.com/gzjjyz/netlib/rudp"
+)
+
+// UDPServer is a TCPServer over reliable UDP. Connections are TCPConn
+// values reading and writing the rudp stream, so agents, framing and every
+// TCPServer option work unchanged.
+type UDPServer struct {
+	*TCPServer
+	// Config tunes the reliable UDP layer.
+	Config rudp.Config
+	// WrapPacketConn wraps the UDP socket before use, e.g. with
+	// rudp.NewLossyPacketConn to simulate packet loss.
+	WrapPacketConn func(net.PacketConn) net.PacketConn
+}
+
+func NewUDPServer(
+	address string,
+	maxConnNum int,
+	writeChanCap int,
+	newAgentHandler func(*TCPConn) Agent,
+	opts *parser.Option,
+) (*UDPServer, error) {
+	tcpServer, err := NewTCPServer(address, maxConnNum, writeChanCap, newAgentHandler, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &UDPServer{TCPServer: tcpServer}
+	tcpServer.Network = "udp"
+	tcpServer.listen = server.listenUDP
+	return server, nil
+}
+
+func (server *UDPServer) listenUDP() (net.Listener, error) {
+	pc, err := net.ListenPacket("udp", server.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if server.WrapPacketConn != nil {
+		pc = server.WrapPacketConn(pc)
+	}
+	return rudp.NewListener(pc, &server.Config), nil
+}
@@ -0,0 +1,132 @@
+package netlib
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gzjjyz/netlib/parser"
+)
+
+// staleProbeTimeout bounds dialing an existing socket file to find out
+// whether a process still serves it.
+const staleProbeTimeout = time.Second
+
+// NewUnixServer returns a TCPServer listening on the unix socket path.
+func NewUnixServer(
+	path string,
+	maxConnNum int,
+	writeChanCap int,
+	newAgentHandler func(*TCPConn) Agent,
+	opts *parser.Option,
+) (*TCPServer, error) {
+	server, err := NewTCPServer(path, maxConnNum, writeChanCap, newAgentHandler, opts)
+	if err != nil {
+		return nil, err
+	}
+	server.Network = "unix"
+	return server, nil
+}
+
+// NewUnixClient returns a TCPClient dialing the unix socket path.
+func NewUnixClient(
+	path string,
+	writeChanCap int,
+	interval time.Duration,
+	newAgentHandler func(*TCPConn) Agent,
+	opts *parser.Option,
+) (*TCPClient, error) {
+	client, err := NewTCPClient(path, writeChanCap, interval, newAgentHandler, opts)
+	if err != nil {
+		return nil, err
+	}
+	client.Network = "unix"
+	return client, nil
+}
+
+// isAbstract reports whether path names a Linux abstract socket, which has
+// no file.
+func isAbstract(path string) bool {
+	return strings.HasPrefix(path, "@")
+}
+
+// listenUnix listens on path after removing a stale socket file. When mode
+// is not zero the socket is bound in a private directory, given mode and
+// only then linked at path, so it is never reachable with other
+// permissions.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if isAbstract(path) {
+		return net.Listen("unix", path)
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	if mode == 0 {
+		return net.Listen("unix", path)
+	}
+
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".sock")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "s")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// the file at path is removed on close instead of tmp
+	ln.SetUnlinkOnClose(false)
+	if err = os.Chmod(tmp, mode); err == nil {
+		// unlike a rename, a link fails when path was taken meanwhile
+		err = os.Link(tmp, path)
+	}
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &unixListener{UnixListener: ln, path: path}, nil
+}
+
+// unixListener removes the socket file linked at path when closed.
+type unixListener struct {
+	*net.UnixListener
+	path string
+	once sync.Once
+}
+
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	l.once.Do(func() { os.Remove(l.path) })
+	return err
+}
+
+// removeStaleSocket removes the socket file at path if no process accepts
+// connections on it anymore, e.g. after a crash.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%v exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, staleProbeTimeout)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%v is in use", path)
+	}
+	return os.Remove(path)
+}
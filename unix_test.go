@@ -0,0 +1,45 @@
+package netlib
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnixSocketMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.sock")
+	server, err := NewUnixServer(path, 10, 10, func(conn *TCPConn) Agent {
+		return &readAgent{conn}
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SocketMode = 0600
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0600 {
+		t.Errorf("socket file mode %v, want 0600", fi.Mode())
+	}
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("%d entries next to the socket, want none", len(entries)-1)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	server.Stop()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file left after Stop: %v", err)
+	}
+}
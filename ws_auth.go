@@ -0,0 +1,112 @@
+package netlib
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// HTTPError rejects an upgrade request from WSOptions.Authenticate with
+// Status, 401 when zero, and Message as the response body.
+type HTTPError struct {
+	Status  int
+	Message string
+}
+
+func (e *HTTPError) Error() string {
+	if e.Message != "" {
+		return e.Message
+	}
+	return http.StatusText(e.status())
+}
+
+func (e *HTTPError) status() int {
+	if e.Status == 0 {
+		return http.StatusUnauthorized
+	}
+	return e.Status
+}
+
+// refuse answers a request failing authentication. Errors other than
+// *HTTPError get 401 without revealing their text.
+func refuse(w http.ResponseWriter, err error) {
+	var he *HTTPError
+	if errors.As(err, &he) {
+		http.Error(w, he.Error(), he.status())
+		return
+	}
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+// originChecker returns the CheckOrigin of opts. Requests without an Origin
+// header come from non-browser clients and are always allowed.
+func originChecker(opts *WSOptions) func(r *http.Request) bool {
+	if opts.CheckOrigin != nil {
+		return opts.CheckOrigin
+	}
+	if len(opts.AllowedOrigins) == 0 {
+		return func(_ *http.Request) bool { return true }
+	}
+
+	patterns := make([]string, len(opts.AllowedOrigins))
+	for i, p := range opts.AllowedOrigins {
+		patterns[i] = strings.ToLower(p)
+	}
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		u, err := url.Parse(origin)
+		if err != nil {
+			return false
+		}
+		for _, p := range patterns {
+			if matchOrigin(p, strings.ToLower(u.Scheme), strings.ToLower(u.Hostname()), originPort(u)) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// matchOrigin matches an AllowedOrigins pattern, "host", "scheme://host" or
+// either with a leading "*." for subdomains and an optional ":port", against
+// an origin. A pattern without a port matches any port.
+func matchOrigin(pattern, scheme, host, port string) bool {
+	if i := strings.Index(pattern, "://"); i >= 0 {
+		if pattern[:i] != scheme {
+			return false
+		}
+		pattern = pattern[i+3:]
+	}
+	if h, p, err := net.SplitHostPort(pattern); err == nil {
+		if p != port {
+			return false
+		}
+		pattern = h
+	}
+	pattern = strings.TrimSuffix(strings.TrimPrefix(pattern, "["), "]")
+
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return host == pattern
+}
+
+// originPort returns the port of an origin, the default one of its scheme
+// when it has none.
+func originPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "ws":
+		return "80"
+	case "https", "wss":
+		return "443"
+	}
+	return ""
+}
@@ -0,0 +1,75 @@
+package netlib
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestOriginChecker(t *testing.T) {
+	check := originChecker(&WSOptions{AllowedOrigins: []string{
+		"game.example.com",
+		"https://secure.example.com",
+		"*.example.org",
+		"localhost:8080",
+		"https://api.example.net:443",
+		"[::1]:3000",
+		"Mixed.Example.COM",
+	}})
+
+	for _, tc := range []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},
+
+		{"https://game.example.com", true},
+		{"http://game.example.com:9000", true},
+		{"https://game.example.com.evil.com", false},
+		{"https://evil.com", false},
+
+		// scheme-qualified
+		{"https://secure.example.com", true},
+		{"http://secure.example.com", false},
+
+		// subdomains only
+		{"https://a.example.org", true},
+		{"https://a.b.example.org", true},
+		{"https://example.org", false},
+		{"https://badexample.org", false},
+
+		// explicit and default ports
+		{"http://localhost:8080", true},
+		{"http://localhost:8081", false},
+		{"http://localhost", false},
+		{"https://api.example.net", true},
+		{"https://api.example.net:443", true},
+		{"https://api.example.net:8443", false},
+
+		// IPv6
+		{"http://[::1]:3000", true},
+		{"http://[::1]:3001", false},
+
+		// mixed case
+		{"HTTPS://GAME.EXAMPLE.COM", true},
+		{"https://mixed.example.com", true},
+
+		{"://bad", false},
+	} {
+		r, _ := http.NewRequest("GET", "/", nil)
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		if got := check(r); got != tc.want {
+			t.Errorf("origin %q allowed %v, want %v", tc.origin, got, tc.want)
+		}
+	}
+}
+
+func TestOriginCheckerEmpty(t *testing.T) {
+	check := originChecker(&WSOptions{})
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("Origin", "https://anywhere.example")
+	if !check(r) {
+		t.Error("empty AllowedOrigins rejected an origin")
+	}
+}
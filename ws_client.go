@@ -1,9 +1,13 @@
 package netlib
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/gzjjyz/netlib/log"
+	"github.com/gzjjyz/netlib/metrics"
+	"net/http"
+	"net/url"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -54,84 +58,201 @@ type WSClient struct {
 	HandshakeTimeout time.Duration
 	AutoReconnect    bool
 	NewAgent         func(*WSConn) Agent
-	dialer           websocket.Dialer
-	conn             *websocket.Conn
-	wg               sync.WaitGroup
-	closeFlag        atomic.Bool
+	KeepAlive        KeepAliveOptions
+	Backpressure     BackpressureOptions
+	Metrics          metrics.Metrics
+	// Header returns the headers of the handshake request, e.g. cookies or
+	// an Authorization token. It is called before every attempt so tokens
+	// can be refreshed between reconnections.
+	Header func() http.Header
+	// Subprotocols lists the requested subprotocols, see
+	// WSConn.Subprotocol for the one selected by the server.
+	Subprotocols []string
+	// TLSConfig configures wss connections, e.g. RootCAs to trust a
+	// private CA.
+	TLSConfig *tls.Config
+	// Proxy returns the proxy for a request, e.g. http.ProxyFromEnvironment
+	// or http.ProxyURL with an http or socks5 URL. https proxies are not
+	// supported and fail the attempt. nil dials directly.
+	Proxy func(*http.Request) (*url.URL, error)
+	// MessageType is the type of the messages written by WriteMsg,
+	// BinaryMessage when zero. See WSConn.SetMessageType.
+	MessageType MessageType
+	// CloseTimeout bounds the wait for the server to answer a close frame,
+	// 5 seconds when zero.
+	CloseTimeout time.Duration
+	// EnableCompression negotiates per message compression with the server.
+	EnableCompression bool
+	// Backoff spaces reconnection attempts.
+	Backoff BackoffOptions
+	// OnStateChange is called on every state change, with the reason for
+	// StateDisconnected and StateGaveUp.
+	OnStateChange func(state ClientState, err error)
+	dialer        websocket.Dialer
+	conn          *websocket.Conn
+	wg            sync.WaitGroup
+	closeFlag     atomic.Bool
+	state         atomic.Int32
+	stop          chan struct{}
+}
+
+func (client *WSClient) connConfig() *connConfig {
+	return &connConfig{
+		writeChanCap: client.WriteChanCap,
+		keepAlive:    client.KeepAlive,
+		backpressure: client.Backpressure,
+		metrics:      client.Metrics,
+		messageType:  client.MessageType,
+		closeTimeout: client.CloseTimeout,
+	}
 }
 
 func (client *WSClient) Start() {
 	client.dialer = websocket.Dialer{
-		HandshakeTimeout: client.HandshakeTimeout,
+		HandshakeTimeout:  client.HandshakeTimeout,
+		Subprotocols:      client.Subprotocols,
+		TLSClientConfig:   client.TLSConfig,
+		Proxy:             client.Proxy,
+		EnableCompression: client.EnableCompression,
 	}
 
+	client.Lock()
+	client.stop = make(chan struct{})
+	client.Unlock()
+
 	client.wg.Add(1)
 	go client.connect()
 }
 
-func (client *WSClient) dial() (*websocket.Conn, error) {
+// State returns the current connection state.
+func (client *WSClient) State() ClientState {
+	return ClientState(client.state.Load())
+}
+
+func (client *WSClient) setState(state ClientState, err error) {
+	client.state.Store(int32(state))
+	if client.OnStateChange != nil {
+		client.OnStateChange(state, err)
+	}
+}
+
+func (client *WSClient) dial(failures *int) (*websocket.Conn, *http.Response, error) {
 	for {
-		conn, _, err := client.dialer.Dial(client.Addr, nil)
-		if client.closeFlag.Load() {
-			return nil, errors.New("client closed")
+		client.setState(StateConnecting, nil)
+		var header http.Header
+		if client.Header != nil {
+			header = client.Header()
 		}
-		if err != nil {
-			log.Error("connect to %v error: %v", client.Addr, err)
-
-			if !client.AutoReconnect {
-				return nil, err
+		conn, resp, err := client.dialer.Dial(client.Addr, header)
+		if client.closeFlag.Load() {
+			if conn != nil {
+				conn.Close()
 			}
-			time.Sleep(client.ConnectInterval)
+			return nil, nil, errors.New("client closed")
+		}
+		if err == nil {
+			return conn, resp, nil
+		}
+		if resp != nil {
+			// the handshake was refused, e.g. with 401
+			err = fmt.Errorf("%w: %v", err, resp.Status)
+		}
 
-			continue
+		log.Error("connect to %v error: %v", client.Addr, err)
+		if !client.retry(failures, err) {
+			return nil, nil, err
 		}
-		return conn, nil
 	}
 }
 
+// retry counts a failed attempt and waits before the next one. It reports
+// false when the client gives up or is stopped.
+func (client *WSClient) retry(failures *int, err error) bool {
+	*failures++
+	if !client.AutoReconnect || client.Backoff.exhausted(*failures) {
+		client.setState(StateGaveUp, err)
+		return false
+	}
+	client.setState(StateDisconnected, err)
+	return sleep(client.Backoff.delay(*failures-1, client.ConnectInterval), client.stop)
+}
+
 func (client *WSClient) connect() {
 	defer client.wg.Done()
 
-reconnect:
-	conn, err := client.dial()
-	if err != nil || conn == nil {
-		return
-	}
+	failures := 0
+	for {
+		conn, resp, err := client.dial(&failures)
+		if err != nil {
+			return
+		}
 
-	if client.closeFlag.Load() {
-		conn.Close()
-		return
-	}
+		client.Lock()
+		if client.closeFlag.Load() {
+			client.Unlock()
+			conn.Close()
+			return
+		}
+		client.conn = conn
+		client.Unlock()
 
-	client.conn = conn
+		conn.SetReadLimit(int64(client.MaxMsgLen))
 
-	conn.SetReadLimit(int64(client.MaxMsgLen))
+		wsConn := newWSConn(conn, client.MaxMsgLen, client.connConfig())
+		wsConn.response = resp
+		agent := client.NewAgent(wsConn)
+		if agent == nil {
+			wsConn.finish()
+			client.setState(StateDisconnected, ErrConnClosed)
+			return
+		}
+		client.setState(StateConnected, nil)
+		connected := time.Now()
+		agent.Run()
 
-	wsConn := newWSConn(conn, client.WriteChanCap, client.MaxMsgLen)
-	agent := client.NewAgent(wsConn)
-	if agent == nil {
-		wsConn.Close()
-		return
-	}
-	agent.Run()
+		// cleanup
+		wsConn.finish()
+		agent.OnClose()
 
-	// cleanup
-	wsConn.Close()
-	agent.OnClose()
+		client.Lock()
+		client.conn = nil
+		client.Unlock()
+		if client.closeFlag.Load() {
+			return
+		}
 
-	if client.AutoReconnect {
-		time.Sleep(client.ConnectInterval)
-		goto reconnect
+		reason := wsConn.CloseInfo()
+		if !client.AutoReconnect {
+			client.setState(StateDisconnected, reason)
+			return
+		}
+		if client.Backoff.stable(time.Since(connected)) {
+			failures = 0
+		}
+		if !client.retry(&failures, reason) {
+			return
+		}
 	}
 }
 
+// Stop closes the connection, interrupts a pending reconnection and waits
+// for the agent to return.
 func (client *WSClient) Stop() {
+	client.Lock()
 	if client.closeFlag.Load() {
+		client.Unlock()
 		return
 	}
-
 	client.closeFlag.Store(true)
-	client.conn.Close()
+	if client.stop != nil {
+		close(client.stop)
+	}
+	conn := client.conn
+	client.Unlock()
 
+	if conn != nil {
+		conn.Close()
+	}
 	client.wg.Wait()
+	client.setState(StateStopped, nil)
 }
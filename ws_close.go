@@ -0,0 +1,207 @@
+package netlib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	"github.com/gzjjyz/netlib/log"
+)
+
+// defaultCloseTimeout bounds the wait for the peer to answer a close frame.
+const defaultCloseTimeout = 5 * time.Second
+
+// maxCloseText is the room left for the reason in a close frame.
+const maxCloseText = 123
+
+// wsClosePart leads the queued close frame, like the parts of wsTypeParts.
+var wsClosePart = []byte{websocket.CloseMessage}
+
+// CloseInfo tells why a WS connection ended. It implements error so it can
+// be reported as the reason of a disconnection.
+type CloseInfo struct {
+	// Code is the close code sent or received, 1006 when the connection
+	// ended without a close frame.
+	Code int
+	// Text is the reason of the close frame.
+	Text string
+	// Remote reports whether the peer started the closing handshake.
+	Remote bool
+	// Err is the local cause, e.g. ErrQueueFull, ErrInvalidUTF8,
+	// websocket.ErrReadLimit, ErrRateLimited or a timeout.
+	Err error
+}
+
+func (info *CloseInfo) Error() string {
+	side := "local"
+	if info.Remote {
+		side = "remote"
+	}
+	s := fmt.Sprintf("%s close %d", side, info.Code)
+	if info.Text != "" {
+		s += " " + info.Text
+	}
+	if info.Err != nil {
+		s += ": " + info.Err.Error()
+	}
+	return s
+}
+
+func (info *CloseInfo) Unwrap() error {
+	return info.Err
+}
+
+// CloseInfo returns why the connection ended, nil while it is open. It is
+// set when the agent returns from Run, in time for OnClose.
+func (wsConn *WSConn) CloseInfo() *CloseInfo {
+	wsConn.infoMu.Lock()
+	defer wsConn.infoMu.Unlock()
+	return wsConn.info
+}
+
+func (wsConn *WSConn) setCloseInfo(info *CloseInfo) {
+	wsConn.infoMu.Lock()
+	if wsConn.info == nil {
+		wsConn.info = info
+	}
+	wsConn.infoMu.Unlock()
+}
+
+// CloseWithReason writes the queued messages, then a close frame with code
+// and text, and closes the connection once the peer answers or the close
+// timeout expires. text is cut to 123 bytes. It returns without waiting.
+func (wsConn *WSConn) CloseWithReason(code int, text string) error {
+	if !validCloseCode(code) {
+		return fmt.Errorf("invalid close code %d", code)
+	}
+	text = truncateText(text, maxCloseText)
+
+	wsConn.Lock()
+	defer wsConn.Unlock()
+	if wsConn.closeFlag {
+		return ErrConnClosed
+	}
+	wsConn.setCloseInfo(&CloseInfo{Code: code, Text: text})
+	wsConn.doClose(code, text)
+	return nil
+}
+
+// shutdown is CloseWithReason waiting for queue room until ctx is done,
+// when the connection is destroyed instead.
+func (wsConn *WSConn) shutdown(ctx context.Context, code int, text string) {
+	wsConn.Lock()
+	defer wsConn.Unlock()
+	if wsConn.closeFlag {
+		return
+	}
+
+	err := wsConn.writeChan.waitRoom(0, wsConn, wsConn.done, ctx.Done(), nil)
+	if err != nil {
+		if err == ErrQueueFull {
+			log.Debug("close conn: %v", ctx.Err())
+			wsConn.setCloseInfo(&CloseInfo{Code: websocket.CloseAbnormalClosure, Err: ctx.Err()})
+			wsConn.doDestroy()
+		}
+		return
+	}
+	wsConn.setCloseInfo(&CloseInfo{Code: code, Text: text})
+	wsConn.doClose(code, text)
+}
+
+// closeWith starts the closing handshake because of the local error err.
+func (wsConn *WSConn) closeWith(code int, err error) {
+	text := truncateText(err.Error(), maxCloseText)
+	wsConn.setCloseInfo(&CloseInfo{Code: code, Text: text, Err: err})
+
+	wsConn.Lock()
+	defer wsConn.Unlock()
+	if !wsConn.closeFlag {
+		wsConn.doClose(code, text)
+	}
+}
+
+// doClose queues the close frame, the caller holds the lock.
+func (wsConn *WSConn) doClose(code int, text string) {
+	f := frame{wsClosePart, websocket.FormatCloseMessage(code, text)}
+	if !wsConn.writeChan.tryPush(f) {
+		log.Debug("close conn: channel full")
+		wsConn.doDestroy()
+		return
+	}
+	wsConn.closeFlag = true
+}
+
+// writeClose writes the close frame of f and waits for the answer of the
+// peer, read by ReadMsg or finish.
+func (wsConn *WSConn) writeClose(f frame) {
+	deadline := time.Now().Add(wsConn.closeTimeout)
+	err := wsConn.conn.WriteControl(websocket.CloseMessage, f[1], deadline)
+	if err != nil && err != websocket.ErrCloseSent {
+		return
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-wsConn.readDone:
+	case <-timer.C:
+	}
+}
+
+// readEnded records the error that ended reading.
+func (wsConn *WSConn) readEnded(err error) {
+	var ce *websocket.CloseError
+	switch {
+	case errors.As(err, &ce):
+		wsConn.setCloseInfo(&CloseInfo{Code: ce.Code, Text: ce.Text, Remote: true})
+	case err == websocket.ErrReadLimit:
+		// the close frame was sent by websocket
+		wsConn.setCloseInfo(&CloseInfo{Code: websocket.CloseMessageTooBig, Err: err})
+	default:
+		wsConn.setCloseInfo(&CloseInfo{Code: websocket.CloseAbnormalClosure, Err: err})
+	}
+	wsConn.readOnce.Do(func() { close(wsConn.readDone) })
+}
+
+// finish closes the connection once its agent returned. Nobody reads
+// anymore, so the answer to a close frame is awaited here.
+func (wsConn *WSConn) finish() {
+	wsConn.Close()
+
+	select {
+	case <-wsConn.readDone:
+		return
+	default:
+	}
+	wsConn.conn.SetReadDeadline(time.Now().Add(wsConn.closeTimeout))
+	for {
+		if _, _, err := wsConn.conn.NextReader(); err != nil {
+			wsConn.readEnded(err)
+			return
+		}
+	}
+}
+
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// truncateText cuts s to at most n bytes without splitting a rune.
+func truncateText(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -3,56 +3,222 @@ package netlib
 import (
 	"errors"
 	"fmt"
+	"github.com/gzjjyz/netlib/bufpool"
 	"github.com/gzjjyz/netlib/log"
+	"github.com/gzjjyz/netlib/metrics"
+	"github.com/gzjjyz/netlib/parser"
 	"net"
+	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
 )
 
 type WebsocketConnSet map[*websocket.Conn]struct{}
 
+// MessageType is the type of a WebSocket data message.
+type MessageType int
+
+const (
+	TextMessage   MessageType = websocket.TextMessage
+	BinaryMessage MessageType = websocket.BinaryMessage
+)
+
+func (mt MessageType) String() string {
+	switch mt {
+	case TextMessage:
+		return "text"
+	case BinaryMessage:
+		return "binary"
+	}
+	return "unknown"
+}
+
+// ErrInvalidUTF8 is returned for text messages that are not valid UTF-8.
+// A peer sending one is disconnected with close code 1007, see RFC 6455.
+var ErrInvalidUTF8 = errors.New("invalid utf-8 in text message")
+
+// wsTypeParts lead every queued WS frame to tell the writer goroutine the
+// message type.
+var wsTypeParts = map[MessageType][]byte{
+	TextMessage:   {byte(TextMessage)},
+	BinaryMessage: {byte(BinaryMessage)},
+}
+
 type WSConn struct {
 	sync.Mutex
 	conn      *websocket.Conn
-	writeChan chan []byte
+	writeChan *writeQueue
 	maxMsgLen uint32
 	closeFlag bool
+	keepAlive KeepAliveOptions
+	lastWrite atomic.Int64
+	deadOnce  sync.Once
+	done      chan struct{}
+	metrics   metrics.Metrics
+	stats     connStats
+	session   *Session
+	limiter   *connLimiter
+	response  *http.Response
+	request   *http.Request
+	claims    any
+	msgType   atomic.Int32
+
+	// closing handshake
+	closeTimeout time.Duration
+	readDone     chan struct{}
+	readOnce     sync.Once
+	infoMu       sync.Mutex
+	info         *CloseInfo
 }
 
-func newWSConn(conn *websocket.Conn, pendingWriteNum int, maxMsgLen uint32) *WSConn {
+func newWSConn(conn *websocket.Conn, maxMsgLen uint32, cfg *connConfig) *WSConn {
 	wsConn := new(WSConn)
 	wsConn.conn = conn
-	wsConn.writeChan = make(chan []byte, pendingWriteNum)
+	wsConn.metrics = metricsOrNop(cfg.metrics)
+	wsConn.writeChan = newWriteQueue(cfg.writeChanCap, cfg.backpressure, wsConn.metrics)
+	if cfg.rateLimit != nil {
+		wsConn.limiter = newConnLimiter(cfg.rateLimit, wsConn.metrics)
+	}
 	wsConn.maxMsgLen = maxMsgLen
+	wsConn.SetMessageType(cfg.messageType)
+	wsConn.keepAlive = cfg.keepAlive
+	wsConn.lastWrite.Store(time.Now().UnixNano())
+	wsConn.done = make(chan struct{})
+	wsConn.readDone = make(chan struct{})
+	wsConn.closeTimeout = cfg.closeTimeout
+	if wsConn.closeTimeout <= 0 {
+		wsConn.closeTimeout = defaultCloseTimeout
+	}
+
+	conn.SetPingHandler(func(appData string) error {
+		wsConn.extendReadDeadline()
+		err := conn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(time.Second))
+		if err == websocket.ErrCloseSent {
+			return nil
+		} else if e, ok := err.(net.Error); ok && e.Temporary() {
+			return nil
+		}
+		return err
+	})
+	conn.SetPongHandler(func(string) error {
+		wsConn.extendReadDeadline()
+		return nil
+	})
 
 	go func() {
-		for b := range wsConn.writeChan {
-			if b == nil {
+		for f := range wsConn.writeChan.ch {
+			wsConn.writeChan.dequeued(f)
+			if f == nil {
+				break
+			}
+			if f[0][0] == websocket.CloseMessage {
+				wsConn.writeClose(f)
 				break
 			}
 
-			err := conn.WriteMessage(websocket.BinaryMessage, b)
+			if wsConn.keepAlive.WriteIdleTimeout > 0 {
+				conn.SetWriteDeadline(time.Now().Add(wsConn.keepAlive.WriteIdleTimeout))
+			}
+			err := writeWSMessage(conn, int(f[0][0]), f[1:])
 			if err != nil {
+				wsConn.setCloseInfo(&CloseInfo{Code: websocket.CloseAbnormalClosure, Err: err})
+				if isTimeout(err) {
+					wsConn.dead(err)
+				}
 				break
 			}
+			n := f.size() - 1
+			wsConn.stats.bytesOut.Add(uint64(n))
+			wsConn.stats.msgsOut.Add(1)
+			wsConn.metrics.BytesOut(n)
+			wsConn.metrics.MsgOut()
+			wsConn.lastWrite.Store(time.Now().UnixNano())
 		}
 
 		conn.Close()
+		// wake writers waiting for queue room
+		close(wsConn.done)
 		wsConn.Lock()
 		wsConn.closeFlag = true
+		wsConn.writeChan.drain()
 		wsConn.Unlock()
 	}()
 
+	if wsConn.keepAlive.HeartbeatInterval > 0 {
+		go idleTimer(wsConn.keepAlive.HeartbeatInterval, wsConn.lastWriteTime, wsConn.ping, wsConn.done)
+	}
+
 	return wsConn
 }
 
+// writeWSMessage writes the parts of f as one message without merging them.
+func writeWSMessage(conn *websocket.Conn, messageType int, f frame) error {
+	if len(f) == 1 {
+		return conn.WriteMessage(messageType, f[0])
+	}
+
+	w, err := conn.NextWriter(messageType)
+	if err != nil {
+		return err
+	}
+	for _, part := range f {
+		if _, err = w.Write(part); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	return w.Close()
+}
+
+func (wsConn *WSConn) lastWriteTime() time.Time {
+	return time.Unix(0, wsConn.lastWrite.Load())
+}
+
+func (wsConn *WSConn) ping() {
+	deadline := time.Now().Add(time.Second)
+	if wsConn.keepAlive.WriteIdleTimeout > 0 {
+		deadline = time.Now().Add(wsConn.keepAlive.WriteIdleTimeout)
+	}
+
+	err := wsConn.conn.WriteControl(websocket.PingMessage, nil, deadline)
+	if err != nil {
+		if isTimeout(err) {
+			wsConn.dead(err)
+		}
+		return
+	}
+	wsConn.lastWrite.Store(time.Now().UnixNano())
+}
+
+func (wsConn *WSConn) extendReadDeadline() {
+	if wsConn.keepAlive.ReadIdleTimeout > 0 {
+		wsConn.conn.SetReadDeadline(time.Now().Add(wsConn.keepAlive.ReadIdleTimeout))
+	}
+}
+
+func (wsConn *WSConn) dead(err error) {
+	wsConn.deadOnce.Do(func() {
+		log.Debug("peer %v dead: %v", wsConn.RemoteAddr(), err)
+		if wsConn.keepAlive.OnDead != nil {
+			wsConn.keepAlive.OnDead(wsConn, err)
+		}
+	})
+}
+
+func (wsConn *WSConn) closed() bool {
+	return wsConn.closeFlag
+}
+
 func (wsConn *WSConn) doDestroy() {
-	wsConn.conn.UnderlyingConn().(*net.TCPConn).SetLinger(0)
+	setNoLinger(wsConn.conn.UnderlyingConn())
 	wsConn.conn.Close()
 
 	if !wsConn.closeFlag {
-		close(wsConn.writeChan)
+		wsConn.writeChan.close()
 		wsConn.closeFlag = true
 	}
 }
@@ -64,6 +230,8 @@ func (wsConn *WSConn) Destroy() {
 	wsConn.doDestroy()
 }
 
+// Close closes the connection with code 1000 once the queued messages are
+// written, see CloseWithReason.
 func (wsConn *WSConn) Close() {
 	wsConn.Lock()
 	defer wsConn.Unlock()
@@ -71,18 +239,17 @@ func (wsConn *WSConn) Close() {
 		return
 	}
 
-	wsConn.doWrite(nil)
-	wsConn.closeFlag = true
+	wsConn.setCloseInfo(&CloseInfo{Code: websocket.CloseNormalClosure})
+	wsConn.doClose(websocket.CloseNormalClosure, "")
 }
 
-func (wsConn *WSConn) doWrite(b []byte) {
-	if len(wsConn.writeChan) == cap(wsConn.writeChan) {
-		log.Error("close conn: channel full")
-		wsConn.doDestroy()
-		return
+func (wsConn *WSConn) doWrite(f frame) error {
+	err := wsConn.writeChan.push(f, wsConn, wsConn.done)
+	if err == ErrQueueFull && wsConn.closeFlag {
+		// destroyed by the backpressure policy
+		wsConn.setCloseInfo(&CloseInfo{Code: websocket.CloseAbnormalClosure, Err: err})
 	}
-
-	wsConn.writeChan <- b
+	return err
 }
 
 func (wsConn *WSConn) LocalAddr() net.Addr {
@@ -95,16 +262,119 @@ func (wsConn *WSConn) RemoteAddr() net.Addr {
 
 // goroutine not safe
 func (wsConn *WSConn) ReadMsg() ([]byte, error) {
-	_, b, err := wsConn.conn.ReadMessage()
+	_, b, err := wsConn.ReadMessage()
 	return b, err
 }
 
-// args must not be modified by the others goroutines
-func (wsConn *WSConn) WriteMsg(args ...[]byte) error {
-	wsConn.Lock()
-	defer wsConn.Unlock()
-	if wsConn.closeFlag {
-		return nil
+// ReadMessage is ReadMsg also returning the message type.
+func (wsConn *WSConn) ReadMessage() (MessageType, []byte, error) {
+	for {
+		wsConn.extendReadDeadline()
+		mt, b, err := wsConn.conn.ReadMessage()
+		if err != nil {
+			wsConn.readEnded(err)
+			if isTimeout(err) {
+				wsConn.dead(err)
+			} else if err == websocket.ErrReadLimit {
+				wsConn.metrics.ParseError()
+			}
+			return 0, nil, err
+		}
+		if mt == websocket.TextMessage && !utf8.Valid(b) {
+			wsConn.metrics.ParseError()
+			wsConn.closeWith(websocket.CloseInvalidFramePayloadData, ErrInvalidUTF8)
+			return 0, nil, ErrInvalidUTF8
+		}
+
+		if wsConn.limiter != nil {
+			drop, err := wsConn.limiter.check(wsConn.RemoteAddr(), len(b))
+			if err != nil {
+				wsConn.closeWith(websocket.ClosePolicyViolation, err)
+				return 0, nil, err
+			}
+			if drop {
+				continue
+			}
+		}
+
+		wsConn.stats.bytesIn.Add(uint64(len(b)))
+		wsConn.stats.msgsIn.Add(1)
+		wsConn.metrics.BytesIn(len(b))
+		wsConn.metrics.MsgIn()
+		return MessageType(mt), b, nil
+	}
+}
+
+// ID returns the session ID of a server connection, 0 for client connections.
+func (wsConn *WSConn) ID() uint64 {
+	if wsConn.session == nil {
+		return 0
+	}
+	return wsConn.session.ID()
+}
+
+// Session returns the session of a server connection, nil for client connections.
+func (wsConn *WSConn) Session() *Session {
+	return wsConn.session
+}
+
+// Subprotocol returns the subprotocol negotiated during the handshake.
+func (wsConn *WSConn) Subprotocol() string {
+	return wsConn.conn.Subprotocol()
+}
+
+// HandshakeResponse returns the server response to the handshake of a client
+// connection, nil for server connections.
+func (wsConn *WSConn) HandshakeResponse() *http.Response {
+	return wsConn.response
+}
+
+// Request returns the upgrade request of a server connection, nil for client
+// connections.
+func (wsConn *WSConn) Request() *http.Request {
+	return wsConn.request
+}
+
+// Claims returns what WSOptions.Authenticate returned for the connection.
+func (wsConn *WSConn) Claims() any {
+	return wsConn.claims
+}
+
+func (wsConn *WSConn) Stats() ConnStats {
+	return wsConn.stats.snapshot(wsConn.writeChan.len())
+}
+
+// SetMessageType sets the type of the messages written by WriteMsg and
+// group broadcasts, BinaryMessage when zero.
+func (wsConn *WSConn) SetMessageType(mt MessageType) {
+	if mt == 0 {
+		mt = BinaryMessage
+	}
+	wsConn.msgType.Store(int32(mt))
+}
+
+// MessageType returns the type of the messages written by WriteMsg.
+func (wsConn *WSConn) MessageType() MessageType {
+	return MessageType(wsConn.msgType.Load())
+}
+
+type wsFrameKey struct {
+	maxMsgLen uint32
+	msgType   MessageType
+}
+
+func (wsConn *WSConn) frameKey() any {
+	return wsFrameKey{maxMsgLen: wsConn.maxMsgLen, msgType: wsConn.MessageType()}
+}
+
+func (wsConn *WSConn) packFrame(args ...[]byte) (frame, error) {
+	return wsConn.packMessage(wsConn.MessageType(), args...)
+}
+
+func (wsConn *WSConn) packMessage(mt MessageType, args ...[]byte) (frame, error) {
+	typePart, ok := wsTypeParts[mt]
+	if !ok {
+		return nil, fmt.Errorf("invalid message type %d", mt)
 	}
 
 	// get len
@@ -115,26 +385,59 @@ func (wsConn *WSConn) WriteMsg(args ...[]byte) error {
 
 	// check len
 	if msgLen > wsConn.maxMsgLen {
-		return fmt.Errorf("message too long, exceeded specified limit %d", wsConn.maxMsgLen)
+		return nil, fmt.Errorf("%w, exceeded specified limit %d", parser.ErrMsgTooLong, wsConn.maxMsgLen)
 	} else if msgLen < 1 {
-		return errors.New("message too short")
+		return nil, parser.ErrMsgTooShort
 	}
 
-	// don't copy
-	if len(args) == 1 {
-		wsConn.doWrite(args[0])
-		return nil
+	if mt == TextMessage && !validUTF8(args, int(msgLen)) {
+		return nil, ErrInvalidUTF8
 	}
 
-	// merge the args
-	msg := make([]byte, msgLen)
-	l := 0
-	for i := 0; i < len(args); i++ {
-		copy(msg[l:], args[i])
-		l += len(args[i])
+	// the parts are written as they are, only the slice is copied
+	f := make(frame, 0, len(args)+1)
+	f = append(f, typePart)
+	return append(f, args...), nil
+}
+
+// validUTF8 checks the concatenation of parts, a rune may span two parts.
+func validUTF8(parts [][]byte, n int) bool {
+	if len(parts) == 1 {
+		return utf8.Valid(parts[0])
+	}
+	buf := bufpool.Get(n)[:0]
+	for _, part := range parts {
+		buf = append(buf, part...)
 	}
+	ok := utf8.Valid(buf)
+	bufpool.Put(buf)
+	return ok
+}
 
-	wsConn.doWrite(msg)
+func (wsConn *WSConn) writeFrame(f frame) error {
+	wsConn.Lock()
+	defer wsConn.Unlock()
+	if wsConn.closeFlag {
+		return ErrConnClosed
+	}
 
-	return nil
+	return wsConn.doWrite(f)
+}
+
+// WriteMsg queues a message of the connection message type for writing.
+// It returns ErrConnClosed once the connection is closed and ErrQueueFull
+// when the backpressure policy rejects the message. args must not be
+// modified by the others goroutines
+func (wsConn *WSConn) WriteMsg(args ...[]byte) error {
+	return wsConn.WriteMessage(wsConn.MessageType(), args...)
+}
+
+// WriteMessage is WriteMsg with the message type mt. Text messages must be
+// valid UTF-8.
+func (wsConn *WSConn) WriteMessage(mt MessageType, args ...[]byte) error {
+	f, err := wsConn.packMessage(mt, args...)
+	if err != nil {
+		return err
+	}
+	return wsConn.writeFrame(f)
 }
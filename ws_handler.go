@@ -1,11 +1,14 @@
 package netlib
 
 import (
+	"context"
 	"errors"
 	"github.com/gorilla/websocket"
 	"github.com/gzjjyz/netlib/log"
+	"github.com/gzjjyz/netlib/metrics"
 	"net/http"
 	"sync"
+	"time"
 )
 
 type WSOptions struct {
@@ -13,6 +16,56 @@ type WSOptions struct {
 	WriteChanCap int
 	MaxMsgLen    uint32
 	NewAgent     func(*WSConn) Agent
+
+	// Sessions registers every accepted connection, a new manager is
+	// created when nil. It may be shared with other servers so one manager
+	// covers TCP and WS connections.
+	Sessions *SessionManager
+	// KeepAlive configures idle timeouts and heartbeats of accepted connections.
+	KeepAlive KeepAliveOptions
+	// Backpressure decides what happens to writes when a write queue is full.
+	Backpressure BackpressureOptions
+	// Metrics receives server and connection events, nil disables them.
+	Metrics metrics.Metrics
+	// RateLimit limits inbound messages per connection and new connections
+	// per source IP. Upgrade requests over the IP limits get 429.
+	RateLimit RateLimitOptions
+	// Admit runs after the upgrade and before NewAgent, e.g. the Admit
+	// method of an AdmissionFilter. Rejected connections get the final
+	// message, if any, then a close frame with code 1013 for ErrServerFull
+	// and ErrMaintenance, 1008 otherwise, and the message or the error as
+	// the reason.
+	Admit AdmitFunc
+	// FullMessage is sent as a final message to connections rejected
+	// because of MaxConnNum, before a close frame with code 1013.
+	FullMessage []byte
+	// Authenticate runs before the upgrade, e.g. to check a query token, a
+	// cookie or a header. An error rejects the request with the status of
+	// an *HTTPError, 401 otherwise. The claims are kept on the WSConn.
+	Authenticate func(r *http.Request) (claims any, err error)
+	// AllowedOrigins restricts the Origin of browser requests to these
+	// hosts, e.g. "game.example.com", "https://example.com",
+	// "*.example.com" or "localhost:8080". An entry without a port matches
+	// any port. When empty, every origin is allowed, so set it or
+	// CheckOrigin for servers that browsers may reach from other sites.
+	AllowedOrigins []string
+	// CheckOrigin replaces the AllowedOrigins check.
+	CheckOrigin func(r *http.Request) bool
+	// MessageType is the type of the messages written by WriteMsg,
+	// BinaryMessage when zero. See WSConn.SetMessageType.
+	MessageType MessageType
+	// CloseTimeout bounds the wait for a client to answer a close frame,
+	// 5 seconds when zero.
+	CloseTimeout time.Duration
+	// Subprotocols lists the supported subprotocols by preference, the
+	// first one also requested by the client is selected.
+	Subprotocols []string
+	// EnableCompression negotiates per message compression with clients
+	// that support it.
+	EnableCompression bool
+	// OnShutdown is called for every live connection when Shutdown starts,
+	// e.g. to queue a "going away" message before the connection is closed.
+	OnShutdown func(*WSConn)
 }
 
 func (opt *WSOptions) Validation() error {
@@ -34,12 +87,75 @@ func (opt *WSOptions) Validation() error {
 	return nil
 }
 
+func (opt *WSOptions) connConfig() *connConfig {
+	return &connConfig{
+		writeChanCap: opt.WriteChanCap,
+		keepAlive:    opt.KeepAlive,
+		backpressure: opt.Backpressure,
+		metrics:      opt.Metrics,
+		rateLimit:    &opt.RateLimit,
+		messageType:  opt.MessageType,
+		closeTimeout: opt.CloseTimeout,
+	}
+}
+
+// defaultHTTPTimeout bounds the upgrade of a WSHandler and the requests of
+// a WSServer when no timeout is given.
+const defaultHTTPTimeout = 10 * time.Second
+
+// WSHandler upgrades requests to WebSocket connections served with its own
+// options. It can be mounted on any http.ServeMux, so several endpoints such
+// as /game and /chat may share one port next to other routes:
+//
+//	game, _ := netlib.NewWSHandler(timeout, gameOpts)
+//	mux.Handle("/game", game)
 type WSHandler struct {
 	opts       *WSOptions
 	upgrader   websocket.Upgrader
-	conns      WebsocketConnSet
+	conns      map[*websocket.Conn]*WSConn
 	mutexConns sync.Mutex
 	wg         sync.WaitGroup
+	closed     bool
+	ipLimiter  *ipLimiter
+}
+
+// NewWSHandler returns a handler serving opts. timeout bounds the upgrade
+// handshake, 10 seconds when zero.
+func NewWSHandler(timeout time.Duration, opts *WSOptions) (*WSHandler, error) {
+	if err := opts.Validation(); err != nil {
+		return nil, err
+	}
+	if opts.Sessions == nil {
+		opts.Sessions = NewSessionManager()
+	}
+	return newWSHandler(timeout, opts), nil
+}
+
+func newWSHandler(timeout time.Duration, opts *WSOptions) *WSHandler {
+	if timeout <= 0 {
+		timeout = defaultHTTPTimeout
+	}
+	return &WSHandler{
+		opts:      opts,
+		conns:     make(map[*websocket.Conn]*WSConn),
+		ipLimiter: newIPLimiter(&opts.RateLimit, metricsOrNop(opts.Metrics)),
+		upgrader: websocket.Upgrader{
+			HandshakeTimeout:  timeout,
+			CheckOrigin:       originChecker(opts),
+			Subprotocols:      opts.Subprotocols,
+			EnableCompression: opts.EnableCompression,
+		},
+	}
+}
+
+func (handler *WSHandler) Sessions() *SessionManager {
+	return handler.opts.Sessions
+}
+
+func (handler *WSHandler) isClosed() bool {
+	handler.mutexConns.Lock()
+	defer handler.mutexConns.Unlock()
+	return handler.closed
 }
 
 func (handler *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -47,6 +163,28 @@ func (handler *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", 405)
 		return
 	}
+	if handler.isClosed() {
+		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if handler.ipLimiter != nil {
+		addr := parseRemoteAddr(r.RemoteAddr)
+		if err := handler.ipLimiter.acquire(addr); err != nil {
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			log.Debug("connection from %v: %v", addr, err)
+			return
+		}
+		defer handler.ipLimiter.release(addr)
+	}
+	var claims any
+	if handler.opts.Authenticate != nil {
+		var err error
+		if claims, err = handler.opts.Authenticate(r); err != nil {
+			log.Debug("authenticate %v: %v", r.RemoteAddr, err)
+			refuse(w, err)
+			return
+		}
+	}
 	conn, err := handler.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Debug("upgrade error: %v", err)
@@ -54,36 +192,102 @@ func (handler *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	opts := handler.opts
+	m := metricsOrNop(opts.Metrics)
+	m.ConnAccepted()
 
 	conn.SetReadLimit(int64(opts.MaxMsgLen))
 
-	handler.wg.Add(1)
-	defer handler.wg.Done()
+	if opts.Admit != nil {
+		meta := &AdmitMeta{Network: "ws", TLS: r.TLS, Request: r}
+		if err := opts.Admit(conn.RemoteAddr(), meta); err != nil {
+			handler.reject(conn, err)
+			return
+		}
+	}
 
 	handler.mutexConns.Lock()
-	if len(handler.conns) >= opts.MaxConnNum {
+	if handler.closed {
 		handler.mutexConns.Unlock()
 		conn.Close()
-		log.Error("too many connections")
 		return
 	}
+	if len(handler.conns) >= opts.MaxConnNum {
+		handler.mutexConns.Unlock()
+		handler.reject(conn, Reject(ErrServerFull, opts.FullMessage))
+		return
+	}
+
+	handler.wg.Add(1)
+	defer handler.wg.Done()
 
-	wsConn := newWSConn(conn, opts.WriteChanCap, opts.MaxMsgLen)
+	wsConn := newWSConn(conn, opts.MaxMsgLen, opts.connConfig())
+	wsConn.request = r
+	wsConn.claims = claims
+	wsConn.session = opts.Sessions.add(wsConn)
 	agent := opts.NewAgent(wsConn)
 	if agent == nil {
 		handler.mutexConns.Unlock()
-		wsConn.Close()
+		opts.Sessions.remove(wsConn.session)
+		wsConn.finish()
 		return
 	}
-	handler.conns[conn] = struct{}{}
+	handler.conns[conn] = wsConn
 	handler.mutexConns.Unlock()
+	m.ConnOpened()
 
 	agent.Run()
 
 	// cleanup
-	wsConn.Close()
+	wsConn.finish()
 	handler.mutexConns.Lock()
 	delete(handler.conns, conn)
 	handler.mutexConns.Unlock()
+	opts.Sessions.remove(wsConn.session)
+	m.ConnClosed()
 	agent.OnClose()
 }
+
+// Close refuses new connections, closes the live ones and waits for their
+// agents to return.
+func (handler *WSHandler) Close() {
+	handler.mutexConns.Lock()
+	handler.closed = true
+	for conn := range handler.conns {
+		conn.Close()
+	}
+	handler.mutexConns.Unlock()
+
+	handler.wg.Wait()
+}
+
+// Shutdown refuses new connections and closes the live ones after their
+// queued writes are flushed, see WSServer.Shutdown. The http.Server the
+// handler is mounted on is left to the caller.
+func (handler *WSHandler) Shutdown(ctx context.Context) error {
+	handler.mutexConns.Lock()
+	handler.closed = true
+	conns := make([]*WSConn, 0, len(handler.conns))
+	for _, wsConn := range handler.conns {
+		conns = append(conns, wsConn)
+	}
+	handler.mutexConns.Unlock()
+
+	for _, wsConn := range conns {
+		if handler.opts.OnShutdown != nil {
+			handler.opts.OnShutdown(wsConn)
+		}
+		// a full queue must not hold up the other connections
+		go wsConn.shutdown(ctx, websocket.CloseGoingAway, "server shutting down")
+	}
+
+	err := waitContext(ctx, &handler.wg)
+	if err != nil {
+		handler.mutexConns.Lock()
+		for _, wsConn := range handler.conns {
+			wsConn.Destroy()
+		}
+		handler.mutexConns.Unlock()
+		handler.wg.Wait()
+	}
+	return err
+}
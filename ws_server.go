@@ -1,13 +1,13 @@
 package netlib
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"github.com/gzjjyz/netlib/log"
 	"net"
 	"net/http"
 	"time"
-
-	"github.com/gorilla/websocket"
 )
 
 type WSServer struct {
@@ -16,6 +16,8 @@ type WSServer struct {
 	httpTimeout time.Duration
 	ln          net.Listener
 	handler     *WSHandler
+	httpServer  *http.Server
+	certs       *CertReloader
 }
 
 func NewWSServer(
@@ -26,6 +28,9 @@ func NewWSServer(
 	if err := opts.Validation(); err != nil {
 		return nil, err
 	}
+	if opts.Sessions == nil {
+		opts.Sessions = NewSessionManager()
+	}
 	s := &WSServer{
 		addr:        address,
 		httpTimeout: timeout,
@@ -44,36 +49,56 @@ func (server *WSServer) init() error {
 	return nil
 }
 
-func (server *WSServer) StartTLS(certFile, keyFile string) (err error) {
-	config := &tls.Config{}
-	config.NextProtos = []string{"http/1.1"}
+func (server *WSServer) Sessions() *SessionManager {
+	return server.opts.Sessions
+}
 
-	config.Certificates = make([]tls.Certificate, 1)
-	config.Certificates[0], err = tls.LoadX509KeyPair(certFile, keyFile)
+// StartTLS enables TLS with the key pair in certFile and keyFile. The pair
+// can be reloaded later with ReloadCertificate or CertReloader().Watch.
+func (server *WSServer) StartTLS(certFile, keyFile string) error {
+	certs, err := NewCertReloader(certFile, keyFile)
 	if err != nil {
 		return err
 	}
+	server.certs = certs
+
+	return server.StartTLSConfig(certs.TLSConfig())
+}
+
+// StartTLSConfig enables TLS with config.
+func (server *WSServer) StartTLSConfig(config *tls.Config) error {
+	config = config.Clone()
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"http/1.1"}
+	}
 
 	server.ln = tls.NewListener(server.ln, config)
 	return nil
 }
 
+// CertReloader returns the reloader set up by StartTLS, nil otherwise.
+func (server *WSServer) CertReloader() *CertReloader {
+	return server.certs
+}
+
+// ReloadCertificate reloads the key pair given to StartTLS. On error the
+// previous certificate stays in service.
+func (server *WSServer) ReloadCertificate() error {
+	if server.certs == nil {
+		return errors.New("tls not started with a key pair")
+	}
+	return server.certs.Reload()
+}
+
 func (server *WSServer) Start() error {
 	if server.httpTimeout <= 0 {
-		server.httpTimeout = 10 * time.Second
+		server.httpTimeout = defaultHTTPTimeout
 		log.Info("invalid HTTPTimeout, reset to %v", server.httpTimeout)
 	}
 
-	server.handler = &WSHandler{
-		opts:  server.opts,
-		conns: make(WebsocketConnSet),
-		upgrader: websocket.Upgrader{
-			HandshakeTimeout: server.httpTimeout,
-			CheckOrigin:      func(_ *http.Request) bool { return true },
-		},
-	}
+	server.handler = newWSHandler(server.httpTimeout, server.opts)
 
-	httpServer := &http.Server{
+	server.httpServer = &http.Server{
 		Addr:           server.addr,
 		Handler:        server.handler,
 		ReadTimeout:    server.httpTimeout,
@@ -81,19 +106,27 @@ func (server *WSServer) Start() error {
 		MaxHeaderBytes: 1024,
 	}
 
-	go httpServer.Serve(server.ln)
+	go server.httpServer.Serve(server.ln)
 	return nil
 }
 
 func (server *WSServer) Close() {
-	server.ln.Close()
-
-	server.handler.mutexConns.Lock()
-	for conn := range server.handler.conns {
-		conn.Close()
+	if server.certs != nil {
+		server.certs.Close()
 	}
-	server.handler.conns = nil
-	server.handler.mutexConns.Unlock()
+	server.httpServer.Close()
+	server.handler.Close()
+}
 
-	server.handler.wg.Wait()
+// Shutdown stops the http server from accepting new connections and closes
+// the live ones after their queued writes are flushed. Connections still
+// open when ctx is done are destroyed and ctx.Err() is returned.
+func (server *WSServer) Shutdown(ctx context.Context) error {
+	if server.certs != nil {
+		server.certs.Close()
+	}
+	if err := server.httpServer.Shutdown(ctx); err != nil {
+		server.httpServer.Close()
+	}
+	return server.handler.Shutdown(ctx)
 }